@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/radenrishwan/maildir"
+	"github.com/radenrishwan/pop3"
+	smtp "github.com/radenrishwan/smtp"
+)
+
+var auth = map[string]pop3.Auth{
+	"raden": pop3.NewAuth("raden", "raden"),
+	"test":  pop3.NewAuth("test", "test"),
+}
+
+var (
+	DIR       = flag.String("dir", "mail", "Directory to store the maildirs in. Default is mail")
+	SMTP_PORT = flag.String("smtp-port", "2525", "Port to run the SMTP server on. Default is 2525")
+	POP3_PORT = flag.String("pop3-port", "1100", "Port to run the POP3 server on. Default is 1100")
+	MAX_SIZE  = flag.Int64("max-size", 10<<20, "Maximum message size in bytes, 0 for no limit. Default is 10 MiB")
+)
+
+func main() {
+	flag.Parse()
+
+	store := maildir.New(*DIR)
+
+	pop3Server := pop3.NewServer(":"+*POP3_PORT, store)
+
+	for _, v := range auth {
+		if err := store.Create(v.Username); err != nil {
+			log.Fatalln(err)
+		}
+
+		pop3Server.AddAuth(v)
+	}
+
+	smtpServer := smtp.NewServer(*SMTP_PORT, true, store)
+	smtpServer.MaxMessageBytes = *MAX_SIZE
+
+	go func() {
+		if err := smtpServer.ListenAndServe(); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	if err := pop3Server.ListenAndServe(); err != nil {
+		log.Fatalln(err)
+	}
+}
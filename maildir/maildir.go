@@ -0,0 +1,285 @@
+package maildir
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	smtp "github.com/radenrishwan/smtp"
+)
+
+var (
+	ErrInvalidUser = errors.New("invalid username")
+	ErrNoSuchUser  = smtp.ErrNoSuchUser
+)
+
+// Store keeps a maildir for every user under a root directory, the maildir
+// of a user is <root>/<username>.
+type Store struct {
+	root string
+}
+
+func New(root string) *Store {
+	return &Store{
+		root: root,
+	}
+}
+
+// Create makes the maildir of a user if it does not exist yet.
+func (s *Store) Create(username string) error {
+	dir, err := s.path(username)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Exists reports whether the user has a maildir.
+func (s *Store) Exists(username string) bool {
+	dir, err := s.path(username)
+	if err != nil {
+		return false
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "new"))
+
+	return err == nil && info.IsDir()
+}
+
+// Deliver writes a message to the new directory of every user. The message
+// is written to tmp first and moved to new once it is complete. from is the
+// envelope sender, it is only kept in the Return-Path header of the message.
+func (s *Store) Deliver(usernames []string, from string, r io.Reader) error {
+	if len(usernames) == 0 {
+		return errors.New("no recipients")
+	}
+
+	// a user named by several recipients gets the message once
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, username := range usernames {
+		if seen[username] {
+			continue
+		}
+
+		seen[username] = true
+
+		if !s.Exists(username) {
+			return ErrNoSuchUser
+		}
+
+		dir, _ := s.path(username)
+		dirs = append(dirs, dir)
+	}
+
+	name := uniqueName()
+	tmp := filepath.Join(dirs[0], "tmp", name)
+
+	if err := writeFile(tmp, r); err != nil {
+		os.Remove(tmp)
+
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	for _, dir := range dirs {
+		if err := linkOrCopy(tmp, filepath.Join(dir, "new", name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) path(username string) (string, error) {
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, "/\\\x00") {
+		return "", ErrInvalidUser
+	}
+
+	return filepath.Join(s.root, username), nil
+}
+
+// list the messages of the user in cur, sorted by delivery time
+func (s *Store) list(username string) ([]string, error) {
+	dir, err := s.path(username)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "cur"))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return baseName(names[i]) < baseName(names[j])
+	})
+
+	return names, nil
+}
+
+// move all messages in new to cur, the messages are seen by a client
+func (s *Store) moveNew(username string) error {
+	dir, err := s.path(username)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		name := entry.Name()
+		err := os.Rename(filepath.Join(dir, "new", name), filepath.Join(dir, "cur", withFlags(name, flags(name))))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var deliveries atomic.Uint64
+
+// generate a unique file name, <seconds>.M<microseconds>P<pid>Q<counter>.<host>
+func uniqueName() string {
+	now := time.Now()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), deliveries.Add(1), hostname)
+}
+
+// the unique part of a file name, without the info
+func baseName(name string) string {
+	base, _, _ := strings.Cut(name, ":")
+
+	return base
+}
+
+// the POP3 unique id of a message, the unique part of the file name or its
+// md5 when it can't be used in a UIDL response
+func uid(name string) string {
+	base := baseName(name)
+
+	valid := len(base) <= 70
+	for _, c := range base {
+		if c < 0x21 || c > 0x7e {
+			valid = false
+		}
+	}
+
+	if valid {
+		return base
+	}
+
+	sum := md5.Sum([]byte(base))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// the flags in the info of a file name, e.g. "RS" for "name:2,RS"
+func flags(name string) string {
+	_, info, ok := strings.Cut(name, ":")
+	if !ok || !strings.HasPrefix(info, "2,") {
+		return ""
+	}
+
+	return info[2:]
+}
+
+// the file name with the given flags, flags are kept in ASCII order
+func withFlags(name, flags string) string {
+	f := strings.Split(flags, "")
+	sort.Strings(f)
+
+	return baseName(name) + ":2," + strings.Join(f, "")
+}
+
+func addFlag(name string, flag rune) string {
+	f := flags(name)
+	if strings.ContainsRune(f, flag) {
+		return name
+	}
+
+	return withFlags(name, f+string(flag))
+}
+
+func writeFile(path string, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
+
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	// copy through tmp, so a reader never sees a partial message. The copy
+	// gets its own name, src may be in the same tmp directory.
+	tmp := filepath.Join(filepath.Dir(filepath.Dir(dst)), "tmp", uniqueName())
+	if err := writeFile(tmp, file); err != nil {
+		os.Remove(tmp)
+
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,271 @@
+package maildir
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the names of the files in a directory of the maildir of a user
+func readDir(t *testing.T, s *Store, username, sub string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Join(s.root, username, sub))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
+
+func newTestStore(t *testing.T, usernames ...string) *Store {
+	t.Helper()
+
+	s := New(t.TempDir())
+	for _, username := range usernames {
+		if err := s.Create(username); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s
+}
+
+func TestPath(t *testing.T) {
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"alice", true},
+		{"alice.smith", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../alice", false},
+		{"alice/new", false},
+		{"alice\\new", false},
+		{"alice\x00", false},
+	}
+
+	s := New(t.TempDir())
+
+	for _, tt := range tests {
+		_, err := s.path(tt.username)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("path(%q) error = %v, want valid %v", tt.username, err, tt.valid)
+		}
+
+		if tt.valid {
+			continue
+		}
+
+		if err := s.Create(tt.username); !errors.Is(err, ErrInvalidUser) {
+			t.Errorf("Create(%q) error = %v, want %v", tt.username, err, ErrInvalidUser)
+		}
+
+		if s.Exists(tt.username) {
+			t.Errorf("Exists(%q) = true", tt.username)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	s := newTestStore(t, "alice", "bob")
+
+	message := "Subject: test\r\n\r\nbody\r\n"
+
+	// alice is named twice and gets the message once
+	if err := s.Deliver([]string{"alice", "bob", "alice"}, "carol@example.org", strings.NewReader(message)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"alice", "bob"} {
+		// the message is moved from tmp to new
+		if tmp := readDir(t, s, username, "tmp"); len(tmp) != 0 {
+			t.Errorf("%s has %q in tmp", username, tmp)
+		}
+
+		names := readDir(t, s, username, "new")
+		if len(names) != 1 {
+			t.Fatalf("%s has %q in new, want one message", username, names)
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.root, username, "new", names[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != message {
+			t.Errorf("%s got %q, want %q", username, data, message)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		usernames []string
+		err       error
+	}{
+		{"unknown user", []string{"alice", "nobody"}, ErrNoSuchUser},
+		{"invalid user", []string{"../alice"}, ErrNoSuchUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Deliver(tt.usernames, "carol@example.org", strings.NewReader(message)); !errors.Is(err, tt.err) {
+				t.Fatalf("Deliver() error = %v, want %v", err, tt.err)
+			}
+
+			// nothing is delivered when a recipient is refused
+			if names := readDir(t, s, "alice", "new"); len(names) != 1 {
+				t.Errorf("alice has %q in new", names)
+			}
+		})
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	s := newTestStore(t, "alice")
+
+	messages := []string{"Subject: first\r\n\r\n1\r\n", "Subject: second\r\n\r\nsecond\r\n"}
+	for _, message := range messages {
+		if err := s.Deliver([]string{"alice"}, "carol@example.org", strings.NewReader(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mailbox, err := s.OpenMailbox("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mailbox.Close()
+
+	// opening the mailbox moves the messages from new to cur
+	if names := readDir(t, s, "alice", "new"); len(names) != 0 {
+		t.Errorf("new = %q, want no messages", names)
+	}
+
+	cur := readDir(t, s, "alice", "cur")
+	if len(cur) != 2 {
+		t.Fatalf("cur = %q, want two messages", cur)
+	}
+
+	infos, err := mailbox.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, info := range infos {
+		if info.Size != len(messages[i]) {
+			t.Errorf("message %d size = %d, want %d", i, info.Size, len(messages[i]))
+		}
+
+		if info.UID == "" || strings.Contains(info.UID, ":") {
+			t.Errorf("message %d uid = %q", i, info.UID)
+		}
+
+		r, err := mailbox.Open(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := io.ReadAll(r)
+		r.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != messages[i] {
+			t.Errorf("message %d = %q, want %q", i, data, messages[i])
+		}
+	}
+
+	// opened messages are marked as seen
+	for _, name := range readDir(t, s, "alice", "cur") {
+		if !strings.HasSuffix(name, ":2,S") {
+			t.Errorf("%q is not marked as seen", name)
+		}
+	}
+
+	// the message is only removed on commit
+	if err := mailbox.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := readDir(t, s, "alice", "cur"); len(names) != 2 {
+		t.Errorf("cur = %q before commit", names)
+	}
+
+	if err := mailbox.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	cur = readDir(t, s, "alice", "cur")
+	if len(cur) != 1 || baseName(cur[0]) != infos[1].UID {
+		t.Errorf("cur = %q after commit, want %s", cur, infos[1].UID)
+	}
+}
+
+// a message renamed by another session is found by its unique name
+func TestMailboxRenamed(t *testing.T) {
+	s := newTestStore(t, "alice")
+
+	if err := s.Deliver([]string{"alice"}, "carol@example.org", strings.NewReader("Subject: test\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := s.OpenMailbox("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := s.OpenMailbox("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first session marks the message as seen
+	r, err := first.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Close()
+
+	r, err = second.Open(0)
+	if err != nil {
+		t.Fatalf("Open() of a renamed message: %v", err)
+	}
+
+	r.Close()
+
+	if err := second.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := second.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := readDir(t, s, "alice", "cur"); len(names) != 0 {
+		t.Errorf("cur = %q, want no messages", names)
+	}
+
+	// the message is already removed for the first session
+	if err := first.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Commit(); err != nil {
+		t.Errorf("Commit() of a removed message: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package maildir
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/radenrishwan/pop3"
+)
+
+// OpenMailbox implements pop3.Backend. New messages are moved to cur when the
+// mailbox is opened.
+func (s *Store) OpenMailbox(username string) (pop3.Mailbox, error) {
+	if !s.Exists(username) {
+		return nil, ErrNoSuchUser
+	}
+
+	if err := s.moveNew(username); err != nil {
+		return nil, err
+	}
+
+	names, err := s.list(username)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, _ := s.path(username)
+
+	return &mailbox{
+		dir:     filepath.Join(dir, "cur"),
+		names:   names,
+		deleted: make(map[int]bool),
+	}, nil
+}
+
+type mailbox struct {
+	dir     string
+	names   []string
+	deleted map[int]bool
+}
+
+func (m *mailbox) List() ([]pop3.MessageInfo, error) {
+	infos := make([]pop3.MessageInfo, len(m.names))
+	for i, name := range m.names {
+		info, err := os.Stat(filepath.Join(m.dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		infos[i] = pop3.MessageInfo{
+			Size: int(info.Size()),
+			UID:  uid(name),
+		}
+	}
+
+	return infos, nil
+}
+
+func (m *mailbox) Open(index int) (io.ReadCloser, error) {
+	if index < 0 || index >= len(m.names) {
+		return nil, errors.New("no such message")
+	}
+
+	file, err := os.Open(filepath.Join(m.dir, m.names[index]))
+	if errors.Is(err, os.ErrNotExist) {
+		// renamed by another session
+		var name string
+		if name, err = m.resolve(index); err == nil {
+			file, err = os.Open(filepath.Join(m.dir, name))
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// mark the message as seen
+	seen := addFlag(m.names[index], 'S')
+	if seen != m.names[index] {
+		if err := os.Rename(filepath.Join(m.dir, m.names[index]), filepath.Join(m.dir, seen)); err == nil {
+			m.names[index] = seen
+		}
+	}
+
+	return file, nil
+}
+
+func (m *mailbox) Delete(index int) error {
+	if index < 0 || index >= len(m.names) {
+		return errors.New("no such message")
+	}
+
+	m.deleted[index] = true
+
+	return nil
+}
+
+func (m *mailbox) Commit() error {
+	var errs []error
+	for index := range m.deleted {
+		name, err := m.resolve(index)
+		if err == nil {
+			err = os.Remove(filepath.Join(m.dir, name))
+		}
+
+		// the message may already be removed by another session
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	m.deleted = make(map[int]bool)
+
+	return errors.Join(errs...)
+}
+
+// the current file name of a message. Another session may have renamed it
+// by changing its flags, the message is found again by its unique base name.
+func (m *mailbox) resolve(index int) (string, error) {
+	name := m.names[index]
+	if _, err := os.Stat(filepath.Join(m.dir, name)); !errors.Is(err, os.ErrNotExist) {
+		return name, err
+	}
+
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		if baseName(entry.Name()) == baseName(name) {
+			m.names[index] = entry.Name()
+
+			return entry.Name(), nil
+		}
+	}
+
+	return "", os.ErrNotExist
+}
+
+func (m *mailbox) Close() error {
+	return nil
+}
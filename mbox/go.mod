@@ -0,0 +1,20 @@
+module github.com/radenrishwan/mbox
+
+go 1.22.4
+
+require (
+	github.com/radenrishwan/pop3 v0.0.0-00010101000000-000000000000
+	github.com/radenrishwan/smtp v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/radenrishwan/sasl v0.0.0-00010101000000-000000000000 // indirect
+	golang.org/x/net v0.35.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+)
+
+replace (
+	github.com/radenrishwan/pop3 => ../pop3
+	github.com/radenrishwan/sasl => ../sasl
+	github.com/radenrishwan/smtp => ../smtp
+)
@@ -0,0 +1,137 @@
+package mbox
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	smtp "github.com/radenrishwan/smtp"
+)
+
+var ErrLocked = smtp.ErrMailboxBusy
+
+const (
+	lockTimeout = 10 * time.Second
+	lockRetry   = 100 * time.Millisecond
+	staleAfter  = 5 * time.Minute
+)
+
+// lock holds both the dotlock and the fcntl lock of a mbox file, the
+// dotlock also protects against other goroutines of the same process since
+// fcntl locks are per process.
+type lock struct {
+	file     *os.File
+	dotlock  string
+	released bool
+}
+
+// acquire the locks of the mbox file at path, the file is created if it does
+// not exist. With wait false ErrLocked is returned right away when the
+// mailbox is locked, otherwise it waits up to lockTimeout.
+func acquire(path string, wait bool) (*lock, error) {
+	dotlock := path + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+
+	for {
+		err := createDotlock(dotlock)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		if isStale(dotlock) {
+			os.Remove(dotlock)
+
+			continue
+		}
+
+		if !wait || time.Now().After(deadline) {
+			return nil, ErrLocked
+		}
+
+		time.Sleep(lockRetry)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		os.Remove(dotlock)
+
+		return nil, err
+	}
+
+	for {
+		err := lockFile(file)
+		if err == nil {
+			break
+		}
+
+		if !wait || time.Now().After(deadline) {
+			file.Close()
+			os.Remove(dotlock)
+
+			return nil, ErrLocked
+		}
+
+		time.Sleep(lockRetry)
+	}
+
+	return &lock{
+		file:    file,
+		dotlock: dotlock,
+	}, nil
+}
+
+func (l *lock) release() error {
+	if l.released {
+		return nil
+	}
+
+	l.released = true
+
+	unlockFile(l.file)
+
+	err := l.file.Close()
+	if rmErr := os.Remove(l.dotlock); err == nil {
+		err = rmErr
+	}
+
+	return err
+}
+
+func createDotlock(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	file.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+
+	return file.Close()
+}
+
+// a dotlock is stale when the process that created it is gone, or when it
+// has no pid and is older than staleAfter
+func isStale(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		info, err := os.Stat(path)
+
+		return err == nil && time.Since(info.ModTime()) > staleAfter
+	}
+
+	if pid == os.Getpid() {
+		return false
+	}
+
+	return !processExists(pid)
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package mbox
+
+import "os"
+
+// fcntl is not available, only the dotlock is used
+
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
+
+func processExists(pid int) bool {
+	return true
+}
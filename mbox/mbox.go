@@ -0,0 +1,402 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	smtp "github.com/radenrishwan/smtp"
+)
+
+var (
+	ErrInvalidUser = errors.New("invalid username")
+	ErrNoSuchUser  = smtp.ErrNoSuchUser
+)
+
+// Store keeps a mboxrd file for every user under a root directory, the mbox
+// of a user is <root>/<username>.
+type Store struct {
+	root string
+}
+
+func New(root string) *Store {
+	return &Store{
+		root: root,
+	}
+}
+
+// Create makes an empty mbox for the user if it does not exist yet.
+func (s *Store) Create(username string) error {
+	path, err := s.path(username)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.root, 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// Exists reports whether the user has a mbox.
+func (s *Store) Exists(username string) bool {
+	path, err := s.path(username)
+	if err != nil {
+		return false
+	}
+
+	info, err := os.Stat(path)
+
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Deliver appends a message to the mbox of every user. from is the envelope
+// sender used in the From_ line. The locks of all mboxes are taken before
+// anything is appended, the message is delivered to every user or to none.
+func (s *Store) Deliver(usernames []string, from string, r io.Reader) error {
+	if len(usernames) == 0 {
+		return errors.New("no recipients")
+	}
+
+	// a user named by several recipients gets the message once, the locks
+	// are taken in the same order by every delivery
+	usernames = slices.Clone(usernames)
+	slices.Sort(usernames)
+	usernames = slices.Compact(usernames)
+
+	for _, username := range usernames {
+		if !s.Exists(username) {
+			return ErrNoSuchUser
+		}
+	}
+
+	// the message is only readable once, so keep it in a spool file
+	spool, err := os.CreateTemp("", "mbox-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if err := writeMessage(spool, from, time.Now(), r); err != nil {
+		return err
+	}
+
+	locks := make([]*lock, 0, len(usernames))
+	defer func() {
+		for _, l := range locks {
+			l.release()
+		}
+	}()
+
+	for _, username := range usernames {
+		path, _ := s.path(username)
+
+		l, err := acquire(path, true)
+		if err != nil {
+			return err
+		}
+
+		locks = append(locks, l)
+	}
+
+	sizes := make([]int64, 0, len(locks))
+	for _, l := range locks {
+		size, err := appendTo(l.file, spool)
+		if err != nil {
+			// undo the mboxes already appended to
+			for i, size := range sizes {
+				locks[i].file.Truncate(size)
+			}
+
+			return err
+		}
+
+		sizes = append(sizes, size)
+	}
+
+	return nil
+}
+
+// append the spooled message to a locked mbox, returns the size of the mbox
+// before the message
+func appendTo(file *os.File, spool *os.File) (int64, error) {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	// messages are separated by an empty line
+	if size > 0 {
+		end := make([]byte, 2)
+		n, _ := file.ReadAt(end, size-2)
+
+		if !bytes.HasSuffix(end[:n], []byte("\n\n")) {
+			if _, err := file.WriteString("\n"); err != nil {
+				file.Truncate(size)
+
+				return 0, err
+			}
+		}
+	}
+
+	if _, err := io.Copy(file, spool); err != nil {
+		// don't leave a partial message behind
+		file.Truncate(size)
+
+		return 0, err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Truncate(size)
+
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func (s *Store) path(username string) (string, error) {
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, "/\\\x00") || strings.HasSuffix(username, ".lock") {
+		return "", ErrInvalidUser
+	}
+
+	return filepath.Join(s.root, username), nil
+}
+
+// write a message in mboxrd format, line endings are converted to LF and
+// lines matching ^>*From  are quoted with an extra >. An X-UIDL header is
+// added to keep the POP3 unique id of the message.
+func writeMessage(w io.Writer, from string, date time.Time, r io.Reader) error {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+
+	uid := make([]byte, 16)
+	if _, err := rand.Read(uid); err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(w)
+	writer.WriteString("From " + from + " " + date.UTC().Format(time.ANSIC) + "\n")
+	writer.WriteString(uidHeader + " " + hex.EncodeToString(uid) + "\n")
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if line == "" && err == io.EOF {
+			break
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if isFromLine(line) {
+			line = ">" + line
+		}
+
+		writer.WriteString(line + "\n")
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	writer.WriteString("\n")
+
+	return writer.Flush()
+}
+
+func isFromLine(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, ">"), "From ")
+}
+
+const uidHeader = "X-UIDL:"
+
+type message struct {
+	// offset of the From_ line
+	start int64
+	// offset of the message content, after the From_ line
+	offset int64
+	// length of the message content, without the separating empty line
+	length int64
+	// size of the message with CRLF line endings and unquoted From lines
+	size int
+	// POP3 unique id, from the X-UIDL header or the md5 of the message
+	uid string
+}
+
+// parse the messages in a mbox file
+func parse(r io.Reader) ([]message, error) {
+	var messages []message
+	var offset int64
+	// length of the previous line if it was empty
+	var blank int64
+	// used for messages without X-UIDL header
+	var sum hash.Hash
+	var inHeader bool
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if line == "" && err == io.EOF {
+			break
+		}
+
+		if strings.HasPrefix(line, "From ") && (offset == 0 || blank > 0) {
+			if len(messages) > 0 {
+				// drop the separating empty line
+				messages[len(messages)-1].length -= blank
+				messages[len(messages)-1].size -= 2
+				setUID(&messages[len(messages)-1], sum)
+			}
+
+			messages = append(messages, message{
+				start:  offset,
+				offset: offset + int64(len(line)),
+			})
+
+			sum = md5.New()
+			sum.Write([]byte(line))
+			inHeader = true
+		} else if len(messages) > 0 {
+			m := &messages[len(messages)-1]
+			m.length += int64(len(line))
+			m.size += len(unquote(strings.TrimRight(line, "\r\n"))) + 2
+
+			sum.Write([]byte(line))
+
+			if line == "\n" || line == "\r\n" {
+				inHeader = false
+			}
+
+			if inHeader && m.uid == "" && len(line) > len(uidHeader) && strings.EqualFold(line[:len(uidHeader)], uidHeader) {
+				m.uid = strings.TrimSpace(line[len(uidHeader):])
+			}
+		}
+
+		blank = 0
+		if line == "\n" || line == "\r\n" {
+			blank = int64(len(line))
+		}
+
+		offset += int64(len(line))
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if len(messages) > 0 {
+		if blank > 0 {
+			messages[len(messages)-1].length -= blank
+			messages[len(messages)-1].size -= 2
+		}
+
+		setUID(&messages[len(messages)-1], sum)
+	}
+
+	// the unique ids must be unique in the mailbox, even for copied messages
+	seen := make(map[string]bool)
+	for i := range messages {
+		uid := messages[i].uid
+		for n := 1; seen[uid]; n++ {
+			uid = fmt.Sprintf("%s.%d", messages[i].uid, n)
+		}
+
+		messages[i].uid = uid
+		seen[uid] = true
+	}
+
+	return messages, nil
+}
+
+// use the md5 of the message when the X-UIDL header is missing or can't be
+// used in a UIDL response
+func setUID(m *message, sum hash.Hash) {
+	valid := m.uid != "" && len(m.uid) <= 60
+	for _, c := range m.uid {
+		if c < 0x21 || c > 0x7e {
+			valid = false
+		}
+	}
+
+	if !valid {
+		m.uid = hex.EncodeToString(sum.Sum(nil))
+	}
+}
+
+func unquote(line string) string {
+	if strings.HasPrefix(line, ">") && isFromLine(line) {
+		return line[1:]
+	}
+
+	return line
+}
+
+// messageReader reads a message from the mbox with CRLF line endings and
+// unquoted From lines
+type messageReader struct {
+	reader *bufio.Reader
+	buf    []byte
+}
+
+func newMessageReader(r io.Reader) *messageReader {
+	return &messageReader{
+		reader: bufio.NewReader(r),
+	}
+}
+
+func (m *messageReader) Read(p []byte) (int, error) {
+	for len(m.buf) == 0 {
+		line, err := m.reader.ReadString('\n')
+		if line != "" {
+			m.buf = []byte(unquote(strings.TrimRight(line, "\r\n")) + "\r\n")
+		}
+
+		if err != nil {
+			if len(m.buf) == 0 {
+				return 0, err
+			}
+
+			break
+		}
+	}
+
+	n := copy(p, m.buf)
+	m.buf = m.buf[n:]
+
+	return n, nil
+}
+
+func (m *messageReader) Close() error {
+	return nil
+}
@@ -0,0 +1,192 @@
+package mbox
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		// the lines after the From_ line and the X-UIDL header
+		want string
+	}{
+		{"simple", "Subject: hi\r\n\r\nbody\r\n", "Subject: hi\n\nbody\n\n"},
+		{"from line", "\r\nFrom here\r\n", "\n>From here\n\n"},
+		{"quoted from line", "\r\n>From here\r\n>>From there\r\n", "\n>>From here\n>>>From there\n\n"},
+		{"from header", "From: alice@example.org\r\n\r\nFromage\r\nFrom\r\n", "From: alice@example.org\n\nFromage\nFrom\n\n"},
+		{"quote not at line start", "\r\na >From b\r\n", "\na >From b\n\n"},
+		{"bare lf", "a\nb\n", "a\nb\n\n"},
+		{"missing final line break", "a\r\nFrom b", "a\n>From b\n\n"},
+	}
+
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := writeMessage(&b, "alice@example.org", date, strings.NewReader(tt.message)); err != nil {
+				t.Fatal(err)
+			}
+
+			fromLine, rest, _ := strings.Cut(b.String(), "\n")
+			if fromLine != "From alice@example.org Fri Mar  1 12:00:00 2024" {
+				t.Errorf("From_ line = %q", fromLine)
+			}
+
+			uid, rest, _ := strings.Cut(rest, "\n")
+			if !strings.HasPrefix(uid, uidHeader+" ") {
+				t.Errorf("X-UIDL header = %q", uid)
+			}
+
+			if rest != tt.want {
+				t.Errorf("message = %q, want %q", rest, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{">From here", "From here"},
+		{">>From here", ">From here"},
+		{"From here", "From here"},
+		{">Fromage", ">Fromage"},
+		{"> From here", "> From here"},
+	}
+
+	for _, tt := range tests {
+		if got := unquote(tt.line); got != tt.want {
+			t.Errorf("unquote(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	mbox := "From alice@example.org Fri Mar  1 12:00:00 2024\n" +
+		"X-UIDL: first\n" +
+		"\n" +
+		">From the body\n" +
+		"From without a blank line before\n" +
+		"\n" +
+		"From bob@example.org Fri Mar  1 12:00:00 2024\n" +
+		"Subject: no uid\n" +
+		"\n" +
+		"body\n" +
+		"\n"
+
+	messages, err := parse(strings.NewReader(mbox))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("%d messages, want 2", len(messages))
+	}
+
+	tests := []struct {
+		content string
+		uid     string
+	}{
+		{"X-UIDL: first\n\n>From the body\nFrom without a blank line before\n", "first"},
+		{"Subject: no uid\n\nbody\n", ""},
+	}
+
+	for i, tt := range tests {
+		m := messages[i]
+
+		content := mbox[m.offset : m.offset+m.length]
+		if content != tt.content {
+			t.Errorf("message %d = %q, want %q", i, content, tt.content)
+		}
+
+		if tt.uid != "" && m.uid != tt.uid {
+			t.Errorf("message %d uid = %q, want %q", i, m.uid, tt.uid)
+		}
+
+		// read with CRLF line endings and unquoted From lines
+		read, err := io.ReadAll(newMessageReader(strings.NewReader(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(read) != m.size {
+			t.Errorf("message %d size = %d, read %d octets", i, m.size, len(read))
+		}
+
+		if strings.Contains(string(read), ">From the body") {
+			t.Errorf("message %d is still quoted: %q", i, read)
+		}
+	}
+
+	// without X-UIDL the md5 of the message is used
+	if len(messages[1].uid) != 32 {
+		t.Errorf("uid = %q, want an md5 sum", messages[1].uid)
+	}
+}
+
+// a message is read back over POP3 as it was delivered
+func TestDeliverAndRead(t *testing.T) {
+	s := New(t.TempDir())
+	for _, username := range []string{"alice", "bob"} {
+		if err := s.Create(username); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	message := "Subject: test\r\n\r\nFrom the start\r\n>From quoted\r\n"
+
+	// alice is named twice and gets the message once
+	if err := s.Deliver([]string{"alice", "bob", "alice"}, "carol@example.org", strings.NewReader(message)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Deliver([]string{"alice", "nobody"}, "carol@example.org", strings.NewReader(message)); err != ErrNoSuchUser {
+		t.Fatalf("Deliver() to an unknown user error = %v, want %v", err, ErrNoSuchUser)
+	}
+
+	for _, username := range []string{"alice", "bob"} {
+		mailbox, err := s.OpenMailbox(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		infos, err := mailbox.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(infos) != 1 {
+			t.Fatalf("%s has %d messages, want 1", username, len(infos))
+		}
+
+		r, err := mailbox.Open(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the X-UIDL header is added in front of the message
+		uid, rest, _ := strings.Cut(string(read), "\r\n")
+		if uid != uidHeader+" "+infos[0].UID || rest != message {
+			t.Errorf("%s read %q", username, read)
+		}
+
+		if len(read) != infos[0].Size {
+			t.Errorf("%s size = %d, read %d octets", username, infos[0].Size, len(read))
+		}
+
+		mailbox.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package mbox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/radenrishwan/pop3"
+)
+
+// OpenMailbox implements pop3.Backend. The mbox stays locked until the
+// mailbox is closed, deliveries wait for the lock in the meantime.
+func (s *Store) OpenMailbox(username string) (pop3.Mailbox, error) {
+	if !s.Exists(username) {
+		return nil, ErrNoSuchUser
+	}
+
+	path, _ := s.path(username)
+
+	l, err := acquire(path, false)
+	if errors.Is(err, ErrLocked) {
+		return nil, fmt.Errorf("%w: %w", pop3.ErrMailboxInUse, err)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := parse(l.file)
+	if err != nil {
+		l.release()
+
+		return nil, err
+	}
+
+	return &mailbox{
+		lock:     l,
+		messages: messages,
+		deleted:  make(map[int]bool),
+	}, nil
+}
+
+type mailbox struct {
+	lock     *lock
+	messages []message
+	deleted  map[int]bool
+}
+
+func (m *mailbox) List() ([]pop3.MessageInfo, error) {
+	infos := make([]pop3.MessageInfo, len(m.messages))
+	for i, message := range m.messages {
+		infos[i] = pop3.MessageInfo{
+			Size: message.size,
+			UID:  message.uid,
+		}
+	}
+
+	return infos, nil
+}
+
+func (m *mailbox) Open(index int) (io.ReadCloser, error) {
+	if index < 0 || index >= len(m.messages) {
+		return nil, errors.New("no such message")
+	}
+
+	message := m.messages[index]
+
+	return newMessageReader(io.NewSectionReader(m.lock.file, message.offset, message.length)), nil
+}
+
+func (m *mailbox) Delete(index int) error {
+	if index < 0 || index >= len(m.messages) {
+		return errors.New("no such message")
+	}
+
+	m.deleted[index] = true
+
+	return nil
+}
+
+// Commit compacts the mbox in place, the messages after a deleted one are
+// moved to the front and the file is truncated.
+func (m *mailbox) Commit() error {
+	if len(m.deleted) == 0 {
+		return nil
+	}
+
+	file := m.lock.file
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var kept []message
+	var offset int64
+	for i, message := range m.messages {
+		end := info.Size()
+		if i+1 < len(m.messages) {
+			end = m.messages[i+1].start
+		}
+
+		if m.deleted[i] {
+			continue
+		}
+
+		// the destination is never after the source, so copying forward is safe
+		if offset != message.start {
+			section := io.NewSectionReader(file, message.start, end-message.start)
+			if _, err := io.Copy(io.NewOffsetWriter(file, offset), section); err != nil {
+				return err
+			}
+		}
+
+		moved := message
+		moved.start = offset
+		moved.offset = offset + (message.offset - message.start)
+		kept = append(kept, moved)
+
+		offset += end - message.start
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+
+	m.messages = kept
+	m.deleted = make(map[int]bool)
+
+	return file.Sync()
+}
+
+func (m *mailbox) Close() error {
+	return m.lock.release()
+}
@@ -0,0 +1,14 @@
+package mbox
+
+import smtp "github.com/radenrishwan/smtp"
+
+// NewSession implements smtp.Backend, mail is delivered to the mbox of the
+// local part of every recipient.
+func (s *Store) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return smtp.NewLocalSession(s), nil
+}
+
+// Username returns the user of an address, the lowercase local part.
+func Username(address string) string {
+	return smtp.LocalUsername(address)
+}
@@ -1,5 +1,25 @@
 package pop3
 
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/radenrishwan/sasl"
+)
+
 type Auth struct {
 	Username string
 	Password string
@@ -11,3 +31,232 @@ func NewAuth(username, password string) Auth {
 		Password: password,
 	}
 }
+
+var errAuthCancelled = errors.New("authentication cancelled")
+
+// SecretStore can be implemented by the credential store to return the
+// shared secret of APOP, other stores are asked for the cleartext password.
+type SecretStore interface {
+	Secret(username string) (string, error)
+}
+
+// the shared secret of a user for APOP, verifiers can't be used
+func (s *Server) secret(username string) (string, error) {
+	if store, ok := s.Credentials.(SecretStore); ok {
+		return store.Secret(username)
+	}
+
+	if s.Credentials == nil {
+		return "", sasl.ErrUnknownUser
+	}
+
+	credentials, err := s.Credentials.Credentials(username)
+	if err != nil {
+		return "", err
+	}
+
+	if credentials.Password == "" {
+		return "", sasl.ErrInvalidCredentials
+	}
+
+	return credentials.Password, nil
+}
+
+// the timestamp of the greeting, unique for every connection (RFC 1939
+// section 7)
+func (s *Server) newTimestamp() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return fmt.Sprintf("<%d.%d.%s@%s>", os.Getpid(), time.Now().UnixNano(), hex.EncodeToString(b), s.Hostname)
+}
+
+// APOP name digest, digest is the MD5 of the timestamp of the greeting
+// followed by the shared secret
+func (s *Server) handleApop(conn net.Conn, state *SessionState, command Command) {
+	if state.isAuthenticated {
+		reply(conn, ERR, "Command not permitted in TRANSACTION state")
+
+		return
+	}
+
+	if s.RequireTLSForAuth && !state.isTLS {
+		reply(conn, ERR, RESP_CODE_AUTH+" Encryption required, use STLS first")
+
+		return
+	}
+
+	args := strings.Fields(command.Args)
+	if len(args) != 2 {
+		reply(conn, ERR, "APOP requires a name and a digest")
+
+		return
+	}
+
+	secret, err := s.secret(args[0])
+	if err != nil {
+		if !errors.Is(err, sasl.ErrUnknownUser) && !errors.Is(err, sasl.ErrInvalidCredentials) {
+			slog.Error("Error getting APOP secret", "ERROR", err.Error())
+			reply(conn, ERR, RESP_CODE_SYS_TEMP+" Temporary authentication failure")
+
+			return
+		}
+
+		reply(conn, ERR, RESP_CODE_AUTH+" Authentication failed")
+
+		return
+	}
+
+	digest := md5.Sum([]byte(state.timestamp + secret))
+	expected := hex.EncodeToString(digest[:])
+
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(args[1])), []byte(expected)) != 1 {
+		reply(conn, ERR, RESP_CODE_AUTH+" Authentication failed")
+
+		return
+	}
+
+	s.login(conn, state, args[0])
+}
+
+// the SASL options of a connection, the -PLUS mechanisms need the channel
+// binding of TLS
+func (s *Server) saslOptions(conn net.Conn) sasl.ServerOptions {
+	opts := sasl.ServerOptions{
+		Hostname:      s.Hostname,
+		TokenVerifier: s.TokenVerifier,
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return opts
+	}
+
+	cb, err := sasl.TLSChannelBinding(tlsConn.ConnectionState())
+	if err != nil {
+		slog.Error("Error getting channel binding", "ERROR", err.Error())
+
+		return opts
+	}
+
+	opts.ChannelBinding = cb
+
+	return opts
+}
+
+// AUTH command of RFC 5034. Without a mechanism the supported mechanisms are
+// listed like in RFC 1734. Returns false when the connection was lost.
+func (s *Server) handleAuth(conn net.Conn, scanner *bufio.Scanner, state *SessionState, command Command) bool {
+	if state.isAuthenticated {
+		reply(conn, ERR, "Command not permitted in TRANSACTION state")
+
+		return true
+	}
+
+	if s.RequireTLSForAuth && !state.isTLS {
+		reply(conn, ERR, RESP_CODE_AUTH+" Encryption required, use STLS first")
+
+		return true
+	}
+
+	opts := s.saslOptions(conn)
+
+	args := strings.Fields(command.Args)
+	if len(args) == 0 {
+		reply(conn, OK, "Supported mechanisms follow")
+		replyMultiline(conn, sasl.Mechanisms(opts), true)
+
+		return true
+	}
+
+	exchange, err := sasl.NewServer(args[0], s.Credentials, opts)
+	if err != nil {
+		reply(conn, ERR, "Unrecognized authentication mechanism")
+
+		return true
+	}
+
+	// the initial response is optional, "=" is an empty one
+	var response []byte
+	if len(args) > 1 {
+		response = []byte{}
+
+		if args[1] != "=" {
+			decoded, err := base64.StdEncoding.DecodeString(args[1])
+			if err != nil {
+				reply(conn, ERR, "Invalid base64 encoding")
+
+				return true
+			}
+
+			response = decoded
+		}
+	}
+
+	for {
+		challenge, done, err := exchange.Next(response)
+		if err != nil {
+			replySASLError(conn, err)
+
+			return true
+		}
+
+		// additional data with the success is sent as a challenge, answered
+		// with an empty response
+		if done && len(challenge) == 0 {
+			break
+		}
+
+		replyWithoutStatus(conn, "+ "+base64.StdEncoding.EncodeToString(challenge))
+
+		if !scanner.Scan() {
+			return false
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "*" {
+			log.Println("Client:", line)
+			replySASLError(conn, errAuthCancelled)
+
+			return true
+		}
+
+		log.Println("Client:", LOG_REDACTED)
+
+		response, err = base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			reply(conn, ERR, "Invalid base64 encoding")
+
+			return true
+		}
+
+		if done {
+			if len(response) != 0 {
+				replySASLError(conn, sasl.ErrUnexpectedResponse)
+
+				return true
+			}
+
+			break
+		}
+	}
+
+	s.login(conn, state, exchange.Username())
+
+	return true
+}
+
+func replySASLError(conn net.Conn, err error) {
+	switch {
+	case errors.Is(err, errAuthCancelled):
+		reply(conn, ERR, "Authentication cancelled")
+	case errors.Is(err, sasl.ErrInvalidCredentials):
+		reply(conn, ERR, RESP_CODE_AUTH+" Authentication failed")
+	case errors.Is(err, sasl.ErrTemporaryFailure):
+		slog.Error("Error checking credentials", "ERROR", err.Error())
+		reply(conn, ERR, RESP_CODE_SYS_TEMP+" Temporary authentication failure")
+	default:
+		reply(conn, ERR, "Invalid authentication response")
+	}
+}
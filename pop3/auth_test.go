@@ -0,0 +1,295 @@
+package pop3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/radenrishwan/sasl"
+)
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// authenticate with a SASL client, the final reply is returned
+func (c *testClient) auth(client sasl.Client) string {
+	c.t.Helper()
+
+	mechanism, response, err := client.Start()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	command := "AUTH " + mechanism
+	if response != nil {
+		command += " " + base64.StdEncoding.EncodeToString(response)
+		if len(response) == 0 {
+			command += "="
+		}
+	}
+
+	line := c.cmd(command)
+	for strings.HasPrefix(line, "+ ") {
+		challenge, err := base64.StdEncoding.DecodeString(line[2:])
+		if err != nil {
+			c.t.Fatalf("invalid challenge %q", line)
+		}
+
+		response, err := client.Next(challenge)
+		if err != nil {
+			// the server sent an error in the challenge
+			line = c.cmd("*")
+
+			continue
+		}
+
+		line = c.cmd(base64.StdEncoding.EncodeToString(response))
+	}
+
+	return line
+}
+
+func TestAuth(t *testing.T) {
+	tests := []struct {
+		mechanism string
+		username  string
+		password  string
+		reply     string
+	}{
+		{sasl.MECHANISM_PLAIN, "alice", "secret", OK},
+		{sasl.MECHANISM_PLAIN, "alice", "wrong", "-ERR [AUTH]"},
+		{sasl.MECHANISM_LOGIN, "alice", "secret", OK},
+		{sasl.MECHANISM_LOGIN, "mallory", "secret", "-ERR [AUTH]"},
+		{sasl.MECHANISM_CRAM_MD5, "alice", "secret", OK},
+		{sasl.MECHANISM_CRAM_MD5, "alice", "wrong", "-ERR [AUTH]"},
+		{sasl.MECHANISM_SCRAM_SHA_1, "alice", "secret", OK},
+		{sasl.MECHANISM_SCRAM_SHA_256, "alice", "secret", OK},
+		{sasl.MECHANISM_SCRAM_SHA_256, "alice", "wrong", "-ERR [AUTH]"},
+		{sasl.MECHANISM_SCRAM_SHA_256, "mallory", "secret", "-ERR [AUTH]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mechanism+" "+tt.username+" "+tt.password, func(t *testing.T) {
+			s, _ := newTestServer()
+
+			client, err := sasl.NewClient(tt.mechanism, tt.username, tt.password, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := dial(t, s)
+			if line := c.auth(client); !strings.HasPrefix(line, tt.reply) {
+				t.Fatalf("AUTH reply = %q, want %q", line, tt.reply)
+			}
+
+			stat := "+OK 2 "
+			if tt.reply != OK {
+				stat = ERR
+			}
+
+			c.run([]step{{command: "STAT", reply: stat}})
+		})
+	}
+}
+
+func TestAuthCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"list mechanisms", []step{
+			{command: "AUTH", reply: OK, lines: []string{"SCRAM-SHA-256", "SCRAM-SHA-1", "CRAM-MD5", "PLAIN", "LOGIN"}},
+		}},
+		{"initial response", []step{
+			{command: "AUTH PLAIN " + b64("\x00alice\x00secret"), reply: OK},
+			{command: "AUTH PLAIN " + b64("\x00alice\x00secret"), reply: ERR},
+		}},
+		{"continuation", []step{
+			{command: "AUTH PLAIN", reply: "+ "},
+			{command: b64("\x00alice\x00secret"), reply: OK},
+		}},
+		{"empty initial response", []step{
+			{command: "AUTH PLAIN =", reply: ERR},
+			{command: "NOOP", reply: OK},
+		}},
+		{"cancelled", []step{
+			{command: "AUTH LOGIN", reply: "+ " + b64("Username:")},
+			{command: b64("alice"), reply: "+ " + b64("Password:")},
+			{command: "*", reply: "-ERR Authentication cancelled"},
+			{command: "STAT", reply: ERR},
+		}},
+		{"invalid base64", []step{
+			{command: "AUTH PLAIN", reply: "+ "},
+			{command: "not base64!", reply: ERR},
+			{command: "AUTH PLAIN !", reply: ERR},
+			{command: "NOOP", reply: OK},
+		}},
+		{"unknown mechanism", []step{
+			{command: "AUTH DIGEST-MD5", reply: ERR},
+			{command: "AUTH OAUTHBEARER", reply: ERR},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer()
+
+			c := dial(t, s)
+			c.run(tt.steps)
+		})
+	}
+}
+
+// secretStore has APOP secrets that aren't login passwords
+type secretStore struct {
+	*sasl.MemoryStore
+	secrets map[string]string
+}
+
+func (s secretStore) Secret(username string) (string, error) {
+	secret, ok := s.secrets[username]
+	if !ok {
+		return "", sasl.ErrUnknownUser
+	}
+
+	return secret, nil
+}
+
+func apopDigest(timestamp, secret string) string {
+	digest := md5.Sum([]byte(timestamp + secret))
+
+	return hex.EncodeToString(digest[:])
+}
+
+func TestApop(t *testing.T) {
+	verifier, err := sasl.NewScramVerifier("SHA-256", "hunter2", sasl.SCRAM_ITERATIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		// the digest is computed with the timestamp of the greeting, digest
+		// changes it
+		secret string
+		digest func(digest string) string
+		store  func(store *sasl.MemoryStore) sasl.CredentialStore
+		reply  string
+	}{
+		{name: "valid", username: "alice", secret: "secret", reply: OK},
+		{name: "upper case digest", username: "alice", secret: "secret", digest: strings.ToUpper, reply: OK},
+		{name: "wrong secret", username: "alice", secret: "wrong", reply: "-ERR [AUTH]"},
+		{name: "unknown user", username: "mallory", secret: "secret", reply: "-ERR [AUTH]"},
+		{name: "other timestamp", username: "alice", secret: "secret", digest: func(string) string { return apopDigest("<1.2@localhost>", "secret") }, reply: "-ERR [AUTH]"},
+		{name: "missing digest", username: "alice", digest: func(string) string { return "" }, reply: ERR},
+		{
+			name:     "verifier only",
+			username: "carol",
+			secret:   "hunter2",
+			store: func(store *sasl.MemoryStore) sasl.CredentialStore {
+				store.AddVerifiers("carol", verifier)
+
+				return store
+			},
+			reply: "-ERR [AUTH]",
+		},
+		{
+			name:     "secret store",
+			username: "alice",
+			secret:   "apop secret",
+			store: func(store *sasl.MemoryStore) sasl.CredentialStore {
+				return secretStore{MemoryStore: store, secrets: map[string]string{"alice": "apop secret"}}
+			},
+			reply: OK,
+		},
+		{
+			name:     "password with secret store",
+			username: "alice",
+			secret:   "secret",
+			store: func(store *sasl.MemoryStore) sasl.CredentialStore {
+				return secretStore{MemoryStore: store, secrets: map[string]string{"alice": "apop secret"}}
+			},
+			reply: "-ERR [AUTH]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer()
+			if tt.store != nil {
+				s.Credentials = tt.store(s.store)
+			}
+
+			c := dial(t, s)
+
+			i := strings.Index(c.greeting, "<")
+			if i < 0 || !strings.HasSuffix(c.greeting, ">") {
+				t.Fatalf("greeting = %q, want a timestamp", c.greeting)
+			}
+
+			digest := apopDigest(c.greeting[i:], tt.secret)
+			if tt.digest != nil {
+				digest = tt.digest(digest)
+			}
+
+			c.run([]step{{command: "APOP " + tt.username + " " + digest, reply: tt.reply}})
+
+			stat := ERR
+			if tt.reply == OK {
+				stat = "+OK 2 "
+			}
+
+			c.run([]step{{command: "STAT", reply: stat}})
+		})
+	}
+}
+
+func TestApopTimestamp(t *testing.T) {
+	s, _ := newTestServer()
+
+	// every greeting has an own timestamp, so a digest can't be replayed
+	first := dial(t, s).greeting
+	second := dial(t, s).greeting
+
+	if first == second {
+		t.Errorf("greetings are the same: %q", first)
+	}
+}
+
+// the passwords and SASL responses are not logged
+func TestAuthNotLogged(t *testing.T) {
+	var output bytes.Buffer
+
+	writer := log.Writer()
+	log.SetOutput(&output)
+	defer log.SetOutput(writer)
+
+	secrets := []string{"secret", b64("secret"), b64("\x00alice\x00secret")}
+
+	scripts := [][]step{
+		{{command: "USER alice", reply: OK}, {command: "PASS secret", reply: OK}},
+		{{command: "AUTH PLAIN " + b64("\x00alice\x00secret"), reply: OK}},
+		{{command: "AUTH PLAIN", reply: "+ "}, {command: b64("\x00alice\x00secret"), reply: OK}},
+		{{command: "AUTH LOGIN", reply: "+ "}, {command: b64("alice"), reply: "+ "}, {command: b64("secret"), reply: OK}},
+	}
+
+	for _, steps := range scripts {
+		s, _ := newTestServer()
+
+		c := dial(t, s)
+		c.run(steps)
+		c.close()
+	}
+
+	for _, secret := range secrets {
+		if strings.Contains(output.String(), secret) {
+			t.Errorf("log contains %q:\n%s", secret, output.String())
+		}
+	}
+}
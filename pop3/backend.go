@@ -0,0 +1,30 @@
+package pop3
+
+import "io"
+
+// Backend gives access to the mailboxes of the users.
+type Backend interface {
+	// open the mailbox of an authenticated user
+	OpenMailbox(username string) (Mailbox, error)
+}
+
+// Mailbox is the maildrop of a single user. Messages are addressed by their
+// index in the result of List, the list must not change while the mailbox is
+// open.
+type Mailbox interface {
+	List() ([]MessageInfo, error)
+	// open the content of a message
+	Open(index int) (io.ReadCloser, error)
+	// mark a message as deleted, it is removed on Commit
+	Delete(index int) error
+	// remove all messages marked as deleted
+	Commit() error
+	Close() error
+}
+
+type MessageInfo struct {
+	Size int
+	// unique id of the message, it must not change between sessions and
+	// contain only printable characters (0x21 to 0x7E), up to 70 characters
+	UID string
+}
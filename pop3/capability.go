@@ -0,0 +1,149 @@
+package pop3
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// response codes, RFC 2449 and RFC 3206
+const (
+	RESP_CODE_IN_USE      = "[IN-USE]"
+	RESP_CODE_LOGIN_DELAY = "[LOGIN-DELAY]"
+	RESP_CODE_SYS_TEMP    = "[SYS/TEMP]"
+	RESP_CODE_SYS_PERM    = "[SYS/PERM]"
+	RESP_CODE_AUTH        = "[AUTH]"
+)
+
+// ErrMailboxInUse can be returned by a Backend when the mailbox is already
+// opened by another session.
+var ErrMailboxInUse = errors.New("mailbox in use")
+
+// CapabilityFunc returns the CAPA line of a capability for a session, an
+// empty line hides the capability.
+type CapabilityFunc func(state *SessionState) string
+
+type capability struct {
+	name string
+	fn   CapabilityFunc
+}
+
+type capabilities struct {
+	mu   sync.RWMutex
+	list []capability
+}
+
+func (c *capabilities) set(name string, fn CapabilityFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name = strings.ToUpper(name)
+	for i, capability := range c.list {
+		if capability.name == name {
+			c.list[i].fn = fn
+
+			return
+		}
+	}
+
+	c.list = append(c.list, capability{name: name, fn: fn})
+}
+
+func (c *capabilities) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name = strings.ToUpper(name)
+	for i, capability := range c.list {
+		if capability.name == name {
+			c.list = append(c.list[:i], c.list[i+1:]...)
+
+			return
+		}
+	}
+}
+
+func (c *capabilities) lines(state *SessionState) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var lines []string
+	for _, capability := range c.list {
+		if line := capability.fn(state); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// SetCapability advertises a capability with static parameters in the CAPA
+// response, e.g. SetCapability("SASL", "PLAIN", "LOGIN").
+func (s *Server) SetCapability(name string, params ...string) {
+	line := strings.Join(append([]string{strings.ToUpper(name)}, params...), " ")
+
+	s.capabilities.set(name, func(state *SessionState) string {
+		return line
+	})
+}
+
+// SetCapabilityFunc advertises a capability whose parameters depend on the
+// session.
+func (s *Server) SetCapabilityFunc(name string, fn CapabilityFunc) {
+	s.capabilities.set(name, fn)
+}
+
+func (s *Server) RemoveCapability(name string) {
+	s.capabilities.remove(name)
+}
+
+// Capabilities returns the CAPA response for a session.
+func (s *Server) Capabilities(state *SessionState) []string {
+	return s.capabilities.lines(state)
+}
+
+// SetExpire advertises how many days messages are kept on the server, a
+// negative number of days advertises NEVER.
+func (s *Server) SetExpire(days int) {
+	if days < 0 {
+		s.SetCapability("EXPIRE", "NEVER")
+
+		return
+	}
+
+	s.SetCapability("EXPIRE", strconv.Itoa(days))
+}
+
+// SetLoginDelay advertises and enforces the minimum delay between two logins
+// of the same user.
+func (s *Server) SetLoginDelay(delay time.Duration) {
+	s.loginDelay = delay
+
+	if delay <= 0 {
+		s.RemoveCapability("LOGIN-DELAY")
+
+		return
+	}
+
+	s.SetCapability("LOGIN-DELAY", strconv.Itoa(int(delay.Seconds())))
+}
+
+// check the login delay of the user, the time of the login is remembered
+func (s *Server) allowLogin(username string) bool {
+	if s.loginDelay <= 0 {
+		return true
+	}
+
+	s.loginsMu.Lock()
+	defer s.loginsMu.Unlock()
+
+	if last, ok := s.logins[username]; ok && time.Since(last) < s.loginDelay {
+		return false
+	}
+
+	s.logins[username] = time.Now()
+
+	return true
+}
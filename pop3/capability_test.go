@@ -0,0 +1,118 @@
+package pop3
+
+import (
+	"testing"
+	"time"
+)
+
+// inUseBackend has the mailboxes locked by another session
+type inUseBackend struct{}
+
+func (inUseBackend) OpenMailbox(username string) (Mailbox, error) {
+	return nil, ErrMailboxInUse
+}
+
+func TestCapa(t *testing.T) {
+	saslLine := "SASL SCRAM-SHA-256 SCRAM-SHA-1 CRAM-MD5 PLAIN LOGIN"
+
+	tests := []struct {
+		name  string
+		setup func(s *Server)
+		want  []string
+	}{
+		{
+			name: "default",
+			want: []string{"TOP", "UIDL", "USER", saslLine, "RESP-CODES", "PIPELINING", "AUTH-RESP-CODE", "IMPLEMENTATION pesen"},
+		},
+		{
+			name: "expire and login delay",
+			setup: func(s *Server) {
+				s.SetExpire(30)
+				s.SetLoginDelay(15 * time.Minute)
+			},
+			want: []string{"TOP", "UIDL", "USER", saslLine, "RESP-CODES", "PIPELINING", "AUTH-RESP-CODE", "IMPLEMENTATION pesen", "EXPIRE 30", "LOGIN-DELAY 900"},
+		},
+		{
+			name: "expire never replaces expire",
+			setup: func(s *Server) {
+				s.SetExpire(30)
+				s.SetExpire(-1)
+			},
+			want: []string{"TOP", "UIDL", "USER", saslLine, "RESP-CODES", "PIPELINING", "AUTH-RESP-CODE", "IMPLEMENTATION pesen", "EXPIRE NEVER"},
+		},
+		{
+			name: "removed and custom",
+			setup: func(s *Server) {
+				s.RemoveCapability("pipelining")
+				s.RemoveCapability("IMPLEMENTATION")
+				s.SetCapability("x-custom", "a", "b")
+			},
+			want: []string{"TOP", "UIDL", "USER", saslLine, "RESP-CODES", "AUTH-RESP-CODE", "X-CUSTOM a b"},
+		},
+		{
+			name: "user hidden without tls",
+			setup: func(s *Server) {
+				s.RequireTLSForAuth = true
+			},
+			want: []string{"TOP", "UIDL", "RESP-CODES", "PIPELINING", "AUTH-RESP-CODE", "IMPLEMENTATION pesen"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer()
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+
+			// CAPA is allowed in the AUTHORIZATION state
+			c := dial(t, s)
+			c.run([]step{{command: "CAPA", reply: OK, lines: tt.want}})
+		})
+	}
+}
+
+func TestResponseCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend Backend
+		delay   time.Duration
+		// logins of alice, the last one must fail with the reply
+		logins int
+		reply  string
+	}{
+		{"invalid password", nil, 0, 0, "-ERR [AUTH]"},
+		{"mailbox in use", inUseBackend{}, 0, 1, "-ERR [IN-USE]"},
+		{"login delay", nil, time.Hour, 2, "-ERR [LOGIN-DELAY]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer()
+			if tt.backend != nil {
+				s.backend = tt.backend
+			}
+
+			s.SetLoginDelay(tt.delay)
+
+			for i := 1; i < tt.logins; i++ {
+				c := dial(t, s)
+				c.login("alice", "secret")
+				c.close()
+			}
+
+			password := "secret"
+			if tt.logins == 0 {
+				password = "wrong"
+			}
+
+			c := dial(t, s)
+			c.run([]step{
+				{command: "USER alice", reply: OK},
+				{command: "PASS " + password, reply: tt.reply},
+				// the session stays in the AUTHORIZATION state
+				{command: "STAT", reply: ERR},
+			})
+		})
+	}
+}
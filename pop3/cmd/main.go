@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
+	"net"
 
 	"github.com/radenrishwan/pop3"
 )
@@ -12,18 +14,73 @@ var auth = map[string]pop3.Auth{
 	"test":  pop3.NewAuth("test", "test"),
 }
 
+var dummyMail = []*pop3.Mail{
+	pop3.NewMail().
+		SetFrom("raden@gmail.com").
+		SetTo("agus@gmail.com").
+		SetSubject("Sample mail 1").
+		SetBody("This is a sample mail 1").
+		AddHeader("Date", "2020-01-01").
+		AddHeader("From", "raden@gmail.com").
+		AddHeader("To", "agus@gmail.com"),
+	pop3.NewMail().
+		SetFrom("raden@gmail.com").
+		SetTo("agus@gmail.com").
+		SetSubject("Sample mail 2").
+		SetBody("This is a sample mail 2").
+		AddHeader("Date", "2020-01-02").
+		AddHeader("From", "raden@gmail.com").
+		AddHeader("To", "agus@gmail.com"),
+	pop3.NewMail().
+		SetFrom("raden@gmail.com").
+		SetTo("acep@gmail.com").
+		SetSubject("Sample mail 3").
+		SetBody("This is a sample mail 3").
+		AddHeader("Date", "2020-01-03").
+		AddHeader("From", "raden@gmail.com").
+		AddHeader("To", "acep@gmail.com"),
+}
+
 var (
 	// DEFAULT PORT FOR POP3 is 110
 	PORT = flag.String("port", "1100", "Port to run the POP3 server on. Default is 1100.")
+	// DEFAULT PORT FOR POP3S is 995
+	TLS_PORT = flag.String("tls-port", "9950", "Port to run the POP3S server on when a certificate is given. Default is 9950.")
+	CERT     = flag.String("cert", "", "TLS certificate file, enables STLS and POP3S")
+	KEY      = flag.String("key", "", "TLS private key file")
 )
 
 func main() {
 	flag.Parse()
 
-	server := pop3.NewServer(":" + *PORT)
+	backend := pop3.NewMemoryBackend()
+	server := pop3.NewServer(":"+*PORT, backend)
+	server.SetExpire(-1)
 
 	for _, v := range auth {
 		server.AddAuth(v)
+		backend.AddMail(v.Username, dummyMail...)
+	}
+
+	if *CERT != "" {
+		cert, err := tls.LoadX509KeyPair(*CERT, *KEY)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		server.RequireTLSForAuth = true
+
+		listener, err := net.Listen("tcp", ":"+*TLS_PORT)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		go func() {
+			if err := server.ServeTLS(listener); err != nil {
+				log.Fatalln(err)
+			}
+		}()
 	}
 
 	if err := server.ListenAndServe(); err != nil {
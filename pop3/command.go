@@ -1,8 +1,10 @@
 package pop3
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strings"
@@ -11,6 +13,8 @@ import (
 const (
 	POP3_COMMAND_USER = "USER"
 	POP3_COMMAND_PASS = "PASS"
+	POP3_COMMAND_AUTH = "AUTH"
+	POP3_COMMAND_APOP = "APOP"
 	POP3_COMMAND_STAT = "STAT"
 	POP3_COMMAND_LIST = "LIST"
 	POP3_COMMAND_RETR = "RETR"
@@ -18,6 +22,10 @@ const (
 	POP3_COMMAND_DELE = "DELE"
 	POP3_COMMAND_RSET = "RSET"
 	POP3_COMMAND_QUIT = "QUIT"
+	POP3_COMMAND_TOP  = "TOP"
+	POP3_COMMAND_UIDL = "UIDL"
+	POP3_COMMAND_CAPA = "CAPA"
+	POP3_COMMAND_STLS = "STLS"
 )
 
 type Command struct {
@@ -33,12 +41,31 @@ func (c *Command) Parse(line string) error {
 
 	c.Command = parts[0]
 	if len(parts) > 1 {
-		c.Args = parts[1]
+		// keep everything after the command, e.g. "TOP 1 10" has "1 10"
+		c.Args = strings.Join(parts[1:], " ")
 	}
 
 	return nil
 }
 
+// replaces the credentials in the logged lines
+const LOG_REDACTED = "[redacted]"
+
+// the line of a command as it is logged, the password of PASS and the
+// initial response of AUTH are left out
+func (c *Command) logLine(line string) string {
+	switch strings.ToUpper(c.Command) {
+	case POP3_COMMAND_PASS:
+		return c.Command + " " + LOG_REDACTED
+	case POP3_COMMAND_AUTH:
+		if args := strings.Fields(c.Args); len(args) > 1 {
+			return c.Command + " " + args[0] + " " + LOG_REDACTED
+		}
+	}
+
+	return strings.TrimSpace(line)
+}
+
 func reply(conn net.Conn, status string, message string) {
 	fmt.Fprintf(conn, "%s %s\r\n", status, message)
 
@@ -60,3 +87,50 @@ func replyMultiline(conn net.Conn, messages []string, end bool) {
 		replyWithoutStatus(conn, ".")
 	}
 }
+
+// send the content of r as a multi-line response, lines starting with a dot
+// are byte-stuffed. With bodyLines >= 0 only the headers and the first
+// bodyLines lines of the body are sent.
+func replyReader(conn net.Conn, r io.Reader, bodyLines int) error {
+	writer := bufio.NewWriter(conn)
+	reader := bufio.NewReader(r)
+
+	inBody := false
+	for {
+		if inBody && bodyLines >= 0 {
+			if bodyLines == 0 {
+				break
+			}
+
+			bodyLines--
+		}
+
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if line == "" && err == io.EOF {
+			break
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			inBody = true
+		}
+
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+
+		writer.WriteString(line + "\r\n")
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	writer.WriteString(".\r\n")
+
+	return writer.Flush()
+}
@@ -1,3 +1,7 @@
 module github.com/radenrishwan/pop3
 
 go 1.22.4
+
+require github.com/radenrishwan/sasl v0.0.0-00010101000000-000000000000
+
+replace github.com/radenrishwan/sasl => ../sasl
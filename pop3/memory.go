@@ -0,0 +1,122 @@
+package pop3
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryBackend keeps all mails in memory, useful for testing.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	mails   map[string][]memoryMail
+	nextUID int
+}
+
+type memoryMail struct {
+	mail *Mail
+	uid  string
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		mails: make(map[string][]memoryMail),
+	}
+}
+
+func (b *MemoryBackend) AddMail(username string, mails ...*Mail) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, mail := range mails {
+		b.nextUID++
+
+		b.mails[username] = append(b.mails[username], memoryMail{
+			mail: mail,
+			uid:  strconv.Itoa(b.nextUID),
+		})
+	}
+}
+
+func (b *MemoryBackend) OpenMailbox(username string) (Mailbox, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// take a snapshot, so the message numbers don't change during the session
+	mails := make([]memoryMail, len(b.mails[username]))
+	copy(mails, b.mails[username])
+
+	return &memoryMailbox{
+		backend:  b,
+		username: username,
+		mails:    mails,
+		deleted:  make(map[int]bool),
+	}, nil
+}
+
+type memoryMailbox struct {
+	backend  *MemoryBackend
+	username string
+	mails    []memoryMail
+	deleted  map[int]bool
+}
+
+func (m *memoryMailbox) List() ([]MessageInfo, error) {
+	infos := make([]MessageInfo, len(m.mails))
+	for i, mail := range m.mails {
+		infos[i] = MessageInfo{
+			Size: len(mail.mail.String()),
+			UID:  mail.uid,
+		}
+	}
+
+	return infos, nil
+}
+
+func (m *memoryMailbox) Open(index int) (io.ReadCloser, error) {
+	if index < 0 || index >= len(m.mails) {
+		return nil, errors.New("no such message")
+	}
+
+	return io.NopCloser(strings.NewReader(m.mails[index].mail.String())), nil
+}
+
+func (m *memoryMailbox) Delete(index int) error {
+	if index < 0 || index >= len(m.mails) {
+		return errors.New("no such message")
+	}
+
+	m.deleted[index] = true
+
+	return nil
+}
+
+func (m *memoryMailbox) Commit() error {
+	b := m.backend
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	deleted := make(map[string]bool)
+	for index := range m.deleted {
+		deleted[m.mails[index].uid] = true
+	}
+
+	var mails []memoryMail
+	for _, mail := range b.mails[m.username] {
+		if !deleted[mail.uid] {
+			mails = append(mails, mail)
+		}
+	}
+
+	b.mails[m.username] = mails
+	m.deleted = make(map[int]bool)
+
+	return nil
+}
+
+func (m *memoryMailbox) Close() error {
+	return nil
+}
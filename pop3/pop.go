@@ -2,12 +2,19 @@ package pop3
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
 	"net"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/radenrishwan/sasl"
 )
 
 const (
@@ -15,43 +22,78 @@ const (
 	ERR = "-ERR"
 )
 
-var dummyMail = []*Mail{
-	NewMail().
-		SetFrom("raden@gmail.com").
-		SetTo("agus@gmail.com").
-		SetSubject("Sample mail 1").
-		SetBody("This is a sample mail 1").
-		AddHeader("Date", "2020-01-01").
-		AddHeader("From", "raden@gmail.com").
-		AddHeader("To", "agus@gmail.com"),
-	NewMail().
-		SetFrom("raden@gmail.com").
-		SetTo("agus@gmail.com").
-		SetSubject("Sample mail 2").
-		SetBody("This is a sample mail 2").
-		AddHeader("Date", "2020-01-02").
-		AddHeader("From", "raden@gmail.com").
-		AddHeader("To", "agus@gmail.com"),
-	NewMail().
-		SetFrom("raden@gmail.com").
-		SetTo("acep@gmail.com").
-		SetSubject("Sample mail 3").
-		SetBody("This is a sample mail 3").
-		AddHeader("Date", "2020-01-03").
-		AddHeader("From", "raden@gmail.com").
-		AddHeader("To", "acep@gmail.com"),
-}
-
 type Server struct {
-	Addr string
-	auth map[string]Auth
+	Addr         string
+	auth         map[string]Auth
+	backend      Backend
+	capabilities capabilities
+	// the store AddAuth adds to
+	store *sasl.MemoryStore
+
+	// users allowed to log in, holds the users of AddAuth by default
+	Credentials sasl.CredentialStore
+	// host name of the server, used in the CRAM-MD5 challenge
+	Hostname string
+	// enables OAUTHBEARER and XOAUTH2 when set, e.g. a *sasl.JWTVerifier
+	TokenVerifier sasl.TokenVerifier
+
+	loginDelay time.Duration
+	loginsMu   sync.Mutex
+	logins     map[string]time.Time
+
+	// enables STLS and ListenAndServeTLS when set
+	TLSConfig *tls.Config
+	// refuse USER and PASS until the connection is encrypted
+	RequireTLSForAuth bool
 }
 
-func NewServer(addr string) *Server {
-	return &Server{
-		Addr: addr,
-		auth: make(map[string]Auth),
+func NewServer(addr string, backend Backend) *Server {
+	store := sasl.NewMemoryStore()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
 	}
+
+	s := &Server{
+		Addr:        addr,
+		auth:        make(map[string]Auth),
+		backend:     backend,
+		store:       store,
+		Credentials: store,
+		Hostname:    hostname,
+		logins:      make(map[string]time.Time),
+	}
+
+	s.SetCapability("TOP")
+	s.SetCapability("UIDL")
+	s.SetCapabilityFunc("USER", func(state *SessionState) string {
+		if s.RequireTLSForAuth && !state.isTLS {
+			return ""
+		}
+
+		return "USER"
+	})
+	s.SetCapabilityFunc("SASL", func(state *SessionState) string {
+		if s.RequireTLSForAuth && !state.isTLS {
+			return ""
+		}
+
+		return "SASL " + strings.Join(sasl.Mechanisms(s.saslOptions(state.conn)), " ")
+	})
+	s.SetCapabilityFunc("STLS", func(state *SessionState) string {
+		if s.TLSConfig == nil || state.isTLS || state.isAuthenticated {
+			return ""
+		}
+
+		return "STLS"
+	})
+	s.SetCapability("RESP-CODES")
+	s.SetCapability("PIPELINING")
+	s.SetCapability("AUTH-RESP-CODE")
+	s.SetCapability("IMPLEMENTATION", "pesen")
+
+	return s
 }
 
 func (s *Server) AddAuth(auth Auth) {
@@ -59,22 +101,30 @@ func (s *Server) AddAuth(auth Auth) {
 		s.auth = make(map[string]Auth)
 	}
 
+	if s.store == nil {
+		s.store = sasl.NewMemoryStore()
+	}
+
+	if s.Credentials == nil {
+		s.Credentials = s.store
+	}
+
 	s.auth[auth.Username] = auth
+	s.store.AddPassword(auth.Username, auth.Password)
 }
 
-func (s Server) GetAuth(username string) *Auth {
+func (s *Server) GetAuth(username string) *Auth {
 	a := s.auth[username]
 
 	return &a
 }
 
-func (s Server) validateAuth(username, password string) bool {
-	auth := s.GetAuth(username)
-	if auth == nil {
+func (s *Server) validateAuth(username, password string) bool {
+	if s.Credentials == nil {
 		return false
 	}
 
-	return auth.Password == password
+	return sasl.CheckPassword(s.Credentials, username, password)
 }
 
 func (s *Server) ListenAndServe() error {
@@ -87,12 +137,48 @@ func (s *Server) ListenAndServe() error {
 		return err
 	}
 
-	defer listener.Close()
-
 	slog.Info("Listening on " + s.Addr)
 
+	return s.Serve(listener)
+}
+
+// ListenAndServeTLS listens on Addr and serves implicit TLS (POP3S) with
+// TLSConfig, the standard port is 995.
+func (s *Server) ListenAndServeTLS() error {
+	if !strings.HasPrefix(s.Addr, ":") {
+		s.Addr = ":" + s.Addr
+	}
+
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Listening with TLS on " + s.Addr)
+
+	return s.ServeTLS(listener)
+}
+
+// ServeTLS serves implicit TLS with TLSConfig on an existing listener.
+func (s *Server) ServeTLS(listener net.Listener) error {
+	if s.TLSConfig == nil {
+		listener.Close()
+
+		return errors.New("TLSConfig is required")
+	}
+
+	return s.Serve(tls.NewListener(listener, s.TLSConfig))
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+
 		if err != nil {
 			slog.Error("Error accepting connection", "ERROR", err.Error())
 			continue
@@ -103,12 +189,27 @@ func (s *Server) ListenAndServe() error {
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
+	// the connection is replaced after STLS
+	defer func() {
+		conn.Close()
+	}()
 
 	state := NewSessionState()
+	defer func() {
+		if state.mailbox != nil {
+			state.mailbox.Close()
+		}
+	}()
+
+	_, state.isTLS = conn.(*tls.Conn)
+	state.conn = conn
+
 	scanner := bufio.NewScanner(conn)
 
-	reply(conn, OK, "POP3 server ready")
+	// the timestamp in the greeting enables APOP
+	state.timestamp = s.newTimestamp()
+
+	reply(conn, OK, "POP3 server ready "+state.timestamp)
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -121,7 +222,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 			continue
 		}
 
-		log.Println("Client:", strings.TrimSpace(line))
+		log.Println("Client:", command.logLine(line))
 
 		if state.shouldQuit {
 			log.Println("Closing connection")
@@ -135,6 +236,12 @@ func (s *Server) handleConnection(conn net.Conn) {
 				continue
 			}
 
+			if s.RequireTLSForAuth && !state.isTLS {
+				reply(conn, ERR, RESP_CODE_AUTH+" Encryption required, use STLS first")
+
+				continue
+			}
+
 			state.username = command.Args
 
 			reply(conn, OK, "User accepted")
@@ -145,6 +252,12 @@ func (s *Server) handleConnection(conn net.Conn) {
 				continue
 			}
 
+			if s.RequireTLSForAuth && !state.isTLS {
+				reply(conn, ERR, RESP_CODE_AUTH+" Encryption required, use STLS first")
+
+				continue
+			}
+
 			if command.Args == "" {
 				reply(conn, ERR, "Missing password")
 
@@ -152,14 +265,18 @@ func (s *Server) handleConnection(conn net.Conn) {
 			}
 
 			if !s.validateAuth(state.username, command.Args) {
-				reply(conn, ERR, "Invalid username or password")
+				reply(conn, ERR, RESP_CODE_AUTH+" Invalid username or password")
 
 				continue
 			}
 
-			state.isAuthenticated = true
-
-			reply(conn, OK, "Authenticated")
+			s.login(conn, state, state.username)
+		case POP3_COMMAND_APOP:
+			s.handleApop(conn, state, command)
+		case POP3_COMMAND_AUTH:
+			if !s.handleAuth(conn, scanner, state, command) {
+				return
+			}
 		case POP3_COMMAND_STAT:
 			if !state.isAuthenticated {
 				reply(conn, ERR, "Not authenticated")
@@ -167,13 +284,9 @@ func (s *Server) handleConnection(conn net.Conn) {
 				continue
 			}
 
-			messageCount := len(dummyMail)
-			size := 0
-			for _, mail := range dummyMail {
-				size += mail.Size()
-			}
+			count, size := state.stat()
 
-			reply(conn, OK, fmt.Sprintf("%d %d", messageCount, size))
+			reply(conn, OK, fmt.Sprintf("%d %d", count, size))
 
 			continue
 		case POP3_COMMAND_LIST:
@@ -183,28 +296,29 @@ func (s *Server) handleConnection(conn net.Conn) {
 				continue
 			}
 
-			reply(conn, OK, fmt.Sprintf(""))
+			// check if has a argument
+			if command.Args != "" {
+				index, err := state.message(command.Args)
+				if err != nil {
+					reply(conn, ERR, err.Error())
 
-			// // check if has a argument
-			// if command.Args != "" {
-			// 	// get specific mail
-			// 	index, err := strconv.Atoi(command.Args)
-			// 	if err != nil {
-			// 		reply(conn, ERR, "Invalid message number")
-			// 	}
+					continue
+				}
 
-			// 	if index < 1 || index > len(dummyMail) {
-			// 		reply(conn, ERR, "No such message")
-			// 	}
+				reply(conn, OK, fmt.Sprintf("%d %d", index+1, state.messages[index].Size))
 
-			// 	replyWithoutStatus(conn, fmt.Sprintf("%d %d", index, dummyMail[index-1].Size()))
+				continue
+			}
 
-			// 	continue
-			// }
+			reply(conn, OK, fmt.Sprintf(""))
 
 			var messages []string
-			for i, mail := range dummyMail {
-				messages = append(messages, fmt.Sprintf("%d %d", i+1, mail.Size()))
+			for i, info := range state.messages {
+				if state.deleted[i] {
+					continue
+				}
+
+				messages = append(messages, fmt.Sprintf("%d %d", i+1, info.Size))
 			}
 
 			replyMultiline(conn, messages, true)
@@ -217,59 +331,198 @@ func (s *Server) handleConnection(conn net.Conn) {
 				continue
 			}
 
-			index, err := strconv.Atoi(command.Args)
+			index, err := state.message(command.Args)
 			if err != nil {
-				reply(conn, ERR, "Invalid message number")
+				reply(conn, ERR, err.Error())
+
+				continue
 			}
 
-			if index < 1 || index > len(dummyMail) {
-				reply(conn, ERR, "No such message")
+			mail, err := state.mailbox.Open(index)
+			if err != nil {
+				reply(conn, ERR, "Unable to open message")
+
+				continue
 			}
 
-			mail := dummyMail[index-1]
+			reply(conn, OK, strconv.Itoa(state.messages[index].Size))
 
-			reply(conn, OK, strconv.Itoa(mail.Size()))
+			err = replyReader(conn, mail, -1)
+			mail.Close()
 
-			replyWithoutStatus(conn, mail.String())
-			replyWithoutStatus(conn, ".")
-		case POP3_COMMAND_NOOP:
-			reply(conn, OK, "NOOP")
+			if err != nil {
+				slog.Error("Error sending message", "ERROR", err.Error())
 
-			continue
-		case POP3_COMMAND_DELE:
+				return
+			}
+		case POP3_COMMAND_TOP:
 			if !state.isAuthenticated {
 				reply(conn, ERR, "Not authenticated")
 
 				continue
 			}
 
-			index, err := strconv.Atoi(command.Args)
+			args := strings.Fields(command.Args)
+			if len(args) != 2 {
+				reply(conn, ERR, "TOP requires a message number and a number of lines")
+
+				continue
+			}
+
+			index, err := state.message(args[0])
+			if err != nil {
+				reply(conn, ERR, err.Error())
+
+				continue
+			}
+
+			lines, err := strconv.Atoi(args[1])
+			if err != nil || lines < 0 {
+				reply(conn, ERR, "Invalid number of lines")
+
+				continue
+			}
+
+			mail, err := state.mailbox.Open(index)
 			if err != nil {
-				reply(conn, ERR, "Invalid message number")
+				reply(conn, ERR, "Unable to open message")
+
+				continue
+			}
+
+			reply(conn, OK, "Top of message follows")
+
+			err = replyReader(conn, mail, lines)
+			mail.Close()
+
+			if err != nil {
+				slog.Error("Error sending message", "ERROR", err.Error())
+
+				return
+			}
+		case POP3_COMMAND_UIDL:
+			if !state.isAuthenticated {
+				reply(conn, ERR, "Not authenticated")
 
 				continue
 			}
 
-			if index < 1 || index > len(dummyMail) {
-				reply(conn, ERR, "No such message")
+			if command.Args != "" {
+				index, err := state.message(command.Args)
+				if err != nil {
+					reply(conn, ERR, err.Error())
+
+					continue
+				}
+
+				reply(conn, OK, fmt.Sprintf("%d %s", index+1, state.messages[index].UID))
 
 				continue
 			}
 
-			dummyMail = append(dummyMail[:index-1], dummyMail[index:]...)
+			reply(conn, OK, "Unique-id listing follows")
+
+			var messages []string
+			for i, info := range state.messages {
+				if state.deleted[i] {
+					continue
+				}
+
+				messages = append(messages, fmt.Sprintf("%d %s", i+1, info.UID))
+			}
+
+			replyMultiline(conn, messages, true)
+		case POP3_COMMAND_STLS:
+			if s.TLSConfig == nil {
+				reply(conn, ERR, "TLS not available")
+
+				continue
+			}
+
+			if state.isTLS {
+				reply(conn, ERR, "Command not permitted when TLS active")
+
+				continue
+			}
+
+			if state.isAuthenticated {
+				reply(conn, ERR, "Command not permitted in TRANSACTION state")
+
+				continue
+			}
+
+			reply(conn, OK, "Begin TLS negotiation")
+
+			tlsConn := tls.Server(conn, s.TLSConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				slog.Error("Error during TLS handshake", "ERROR", err.Error())
+
+				return
+			}
+
+			// commands sent before the handshake are discarded with the old
+			// scanner, and the user has to be given again
+			conn = tlsConn
+			scanner = bufio.NewScanner(conn)
+			state.isTLS = true
+			state.conn = conn
+			state.username = ""
+		case POP3_COMMAND_CAPA:
+			reply(conn, OK, "Capability list follows")
+			replyMultiline(conn, s.Capabilities(state), true)
+		case POP3_COMMAND_NOOP:
+			reply(conn, OK, "NOOP")
+
+			continue
+		case POP3_COMMAND_DELE:
+			if !state.isAuthenticated {
+				reply(conn, ERR, "Not authenticated")
+
+				continue
+			}
+
+			index, err := state.message(command.Args)
+			if err != nil {
+				reply(conn, ERR, err.Error())
+
+				continue
+			}
+
+			// the message is only removed in the UPDATE state
+			state.deleted[index] = true
 
 			reply(conn, OK, "Message deleted")
 		case POP3_COMMAND_RSET:
 			if !state.isAuthenticated {
 				reply(conn, ERR, "Not authenticated")
+
+				continue
 			}
 
-			// clear all buffer and state
-			state = NewSessionState()
+			// unmark all deleted messages
+			state.deleted = make(map[int]bool)
+
+			count, size := state.stat()
+
+			reply(conn, OK, fmt.Sprintf("Maildrop has %d messages (%d octets)", count, size))
 		case POP3_COMMAND_QUIT:
+			// QUIT in the AUTHORIZATION state doesn't enter the UPDATE state
+			if !state.isAuthenticated {
+				reply(conn, OK, "Bye")
+
+				return
+			}
+
+			if err := state.update(); err != nil {
+				slog.Error("Error removing deleted messages", "ERROR", err.Error())
+				reply(conn, ERR, "Some deleted messages not removed")
+
+				return
+			}
+
 			reply(conn, OK, "Bye")
 
-			break
+			return
 		default:
 			reply(conn, ERR, "Unknown command")
 
@@ -281,3 +534,43 @@ func (s *Server) handleConnection(conn net.Conn) {
 		log.Println("Error reading from client:", err)
 	}
 }
+
+// open the mailbox of an authenticated user and enter the TRANSACTION state
+func (s *Server) login(conn net.Conn, state *SessionState, username string) {
+	if !s.allowLogin(username) {
+		reply(conn, ERR, RESP_CODE_LOGIN_DELAY+" Minimum time between logins not elapsed")
+
+		return
+	}
+
+	mailbox, err := s.backend.OpenMailbox(username)
+	if errors.Is(err, ErrMailboxInUse) {
+		reply(conn, ERR, RESP_CODE_IN_USE+" Mailbox already locked")
+
+		return
+	}
+
+	if err != nil {
+		slog.Error("Error opening mailbox", "ERROR", err.Error())
+		reply(conn, ERR, RESP_CODE_SYS_TEMP+" Unable to open mailbox")
+
+		return
+	}
+
+	messages, err := mailbox.List()
+	if err != nil {
+		slog.Error("Error listing messages", "ERROR", err.Error())
+		reply(conn, ERR, RESP_CODE_SYS_TEMP+" Unable to open mailbox")
+
+		mailbox.Close()
+
+		return
+	}
+
+	state.username = username
+	state.isAuthenticated = true
+	state.mailbox = mailbox
+	state.messages = messages
+
+	reply(conn, OK, "Authenticated")
+}
@@ -0,0 +1,251 @@
+package pop3
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient talks to a session of the server over a pipe
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	done chan struct{}
+	// the first line sent by the server
+	greeting string
+}
+
+// a step of a conversation, lines is the content of a multi-line response
+// and nil for a single line response
+type step struct {
+	command string
+	// the prefix of the status line
+	reply string
+	lines []string
+}
+
+func dial(t *testing.T, s *Server) *testClient {
+	t.Helper()
+
+	client, server := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &testClient{
+		t:    t,
+		conn: client,
+		r:    bufio.NewReader(client),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		s.handleConnection(server)
+		close(c.done)
+	}()
+
+	t.Cleanup(c.close)
+
+	c.greeting = c.readLine()
+	if !strings.HasPrefix(c.greeting, OK) {
+		t.Fatalf("greeting = %q", c.greeting)
+	}
+
+	return c
+}
+
+// close the connection and wait for the session to end
+func (c *testClient) close() {
+	c.conn.Close()
+	<-c.done
+}
+
+func (c *testClient) readLine() string {
+	c.t.Helper()
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading reply: %v", err)
+	}
+
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// send a command and read the status line
+func (c *testClient) cmd(command string) string {
+	c.t.Helper()
+
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", command); err != nil {
+		c.t.Fatalf("sending %q: %v", command, err)
+	}
+
+	return c.readLine()
+}
+
+// read the lines of a multi-line response, without byte-stuffing
+func (c *testClient) readLines() []string {
+	c.t.Helper()
+
+	lines := []string{}
+	for {
+		line := c.readLine()
+		if line == "." {
+			return lines
+		}
+
+		lines = append(lines, strings.TrimPrefix(line, "."))
+	}
+}
+
+func (c *testClient) run(steps []step) {
+	c.t.Helper()
+
+	for _, step := range steps {
+		line := c.cmd(step.command)
+		if !strings.HasPrefix(line, step.reply) {
+			c.t.Fatalf("%s: reply = %q, want %q", step.command, line, step.reply)
+		}
+
+		if step.lines == nil {
+			continue
+		}
+
+		if lines := c.readLines(); !reflect.DeepEqual(lines, step.lines) {
+			c.t.Fatalf("%s: lines = %q, want %q", step.command, lines, step.lines)
+		}
+	}
+}
+
+func (c *testClient) login(username, password string) {
+	c.t.Helper()
+
+	c.run([]step{
+		{command: "USER " + username, reply: OK},
+		{command: "PASS " + password, reply: OK},
+	})
+}
+
+func testMail(body string) *Mail {
+	return NewMail().AddHeader("Date", "Mon, 1 Jan 2024 00:00:00 +0000").SetBody(body)
+}
+
+// a server where alice has two messages, the second one has a line starting
+// with a dot
+func newTestServer() (*Server, *MemoryBackend) {
+	backend := NewMemoryBackend()
+	backend.AddMail("alice", testMail("first"), testMail(".hidden dot\r\nline 2\r\nline 3"))
+
+	s := NewServer(":0", backend)
+	s.AddAuth(NewAuth("alice", "secret"))
+	s.AddAuth(NewAuth("bob", "hunter2"))
+
+	return s, backend
+}
+
+func TestMailbox(t *testing.T) {
+	s, _ := newTestServer()
+
+	size1 := len(testMail("first").String())
+	size2 := len(testMail(".hidden dot\r\nline 2\r\nline 3").String())
+
+	c := dial(t, s)
+	c.run([]step{
+		{command: "STAT", reply: ERR},
+		{command: "USER alice", reply: OK},
+		{command: "PASS wrong", reply: ERR},
+		{command: "PASS secret", reply: OK},
+		{command: "STAT", reply: fmt.Sprintf("+OK 2 %d", size1+size2)},
+		{command: "LIST", reply: OK, lines: []string{fmt.Sprintf("1 %d", size1), fmt.Sprintf("2 %d", size2)}},
+		{command: "LIST 2", reply: fmt.Sprintf("+OK 2 %d", size2)},
+		{command: "LIST 3", reply: ERR},
+		{command: "LIST x", reply: ERR},
+		{command: "RETR 1", reply: fmt.Sprintf("+OK %d", size1), lines: []string{"Date: Mon, 1 Jan 2024 00:00:00 +0000", "", "first"}},
+		// the dot is byte-stuffed on the wire
+		{command: "RETR 2", reply: OK, lines: []string{"Date: Mon, 1 Jan 2024 00:00:00 +0000", "", ".hidden dot", "line 2", "line 3"}},
+		{command: "RETR 3", reply: ERR},
+		{command: "DELE 1", reply: OK},
+		{command: "DELE 1", reply: ERR},
+		{command: "RETR 1", reply: ERR},
+		{command: "STAT", reply: fmt.Sprintf("+OK 1 %d", size2)},
+		{command: "LIST", reply: OK, lines: []string{fmt.Sprintf("2 %d", size2)}},
+		{command: "NOOP", reply: OK},
+		{command: "FOO", reply: ERR},
+	})
+
+	// every user has an own mailbox
+	c = dial(t, s)
+	c.login("bob", "hunter2")
+	c.run([]step{
+		{command: "STAT", reply: "+OK 0 0"},
+		{command: "LIST", reply: OK, lines: []string{}},
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+		// the messages left after the session
+		want int
+	}{
+		{"quit", []step{{command: "DELE 1", reply: OK}, {command: "QUIT", reply: OK}}, 1},
+		{"connection lost", []step{{command: "DELE 1", reply: OK}}, 2},
+		{"rset", []step{{command: "DELE 1", reply: OK}, {command: "RSET", reply: "+OK Maildrop has 2 messages"}, {command: "QUIT", reply: OK}}, 2},
+		{"delete all", []step{{command: "DELE 1", reply: OK}, {command: "DELE 2", reply: OK}, {command: "QUIT", reply: OK}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer()
+
+			c := dial(t, s)
+			c.login("alice", "secret")
+			c.run(tt.steps)
+			c.close()
+
+			c = dial(t, s)
+			c.login("alice", "secret")
+			c.run([]step{{command: "STAT", reply: fmt.Sprintf("+OK %d ", tt.want)}})
+		})
+	}
+
+	// QUIT in the AUTHORIZATION state ends the session
+	s, _ := newTestServer()
+
+	c := dial(t, s)
+	c.run([]step{{command: "QUIT", reply: OK}})
+}
+
+func TestTopAndUidl(t *testing.T) {
+	s, _ := newTestServer()
+
+	header := "Date: Mon, 1 Jan 2024 00:00:00 +0000"
+
+	c := dial(t, s)
+	c.login("alice", "secret")
+	c.run([]step{
+		{command: "TOP 2 0", reply: OK, lines: []string{header, ""}},
+		{command: "TOP 2 2", reply: OK, lines: []string{header, "", ".hidden dot", "line 2"}},
+		{command: "TOP 2 10", reply: OK, lines: []string{header, "", ".hidden dot", "line 2", "line 3"}},
+		{command: "TOP 2", reply: ERR},
+		{command: "TOP 2 -1", reply: ERR},
+		{command: "TOP 3 1", reply: ERR},
+		{command: "UIDL", reply: OK, lines: []string{"1 1", "2 2"}},
+		{command: "UIDL 2", reply: "+OK 2 2"},
+		{command: "UIDL 3", reply: ERR},
+		{command: "DELE 1", reply: OK},
+		{command: "UIDL", reply: OK, lines: []string{"2 2"}},
+		{command: "QUIT", reply: OK},
+	})
+
+	// the unique id stays with the message when the numbers change
+	c = dial(t, s)
+	c.login("alice", "secret")
+	c.run([]step{
+		{command: "UIDL", reply: OK, lines: []string{"1 2"}},
+		{command: "TOP 1 1", reply: OK, lines: []string{header, "", ".hidden dot"}},
+	})
+}
@@ -1,9 +1,26 @@
 package pop3
 
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
 type SessionState struct {
 	isAuthenticated bool
 	username        string
 	shouldQuit      bool
+	isTLS           bool
+	// timestamp of the greeting, used by APOP
+	timestamp string
+	// the connection of the session, replaced after STLS
+	conn    net.Conn
+	mailbox Mailbox
+	// the messages of the mailbox when it was opened, the message numbers
+	// don't change during the session
+	messages []MessageInfo
+	// messages marked as deleted, they are removed in the UPDATE state
+	deleted map[int]bool
 }
 
 func NewSessionState() *SessionState {
@@ -11,5 +28,67 @@ func NewSessionState() *SessionState {
 		isAuthenticated: false,
 		username:        "",
 		shouldQuit:      false,
+		deleted:         make(map[int]bool),
+	}
+}
+
+func (s *SessionState) IsAuthenticated() bool {
+	return s.isAuthenticated
+}
+
+func (s *SessionState) IsTLS() bool {
+	return s.isTLS
+}
+
+func (s *SessionState) Username() string {
+	return s.username
+}
+
+// get the index of a message number, messages marked as deleted can't be
+// accessed
+func (s *SessionState) message(arg string) (int, error) {
+	number, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, errors.New("Invalid message number")
+	}
+
+	if number < 1 || number > len(s.messages) {
+		return 0, errors.New("No such message")
+	}
+
+	if s.deleted[number-1] {
+		return 0, errors.New("Message already deleted")
 	}
+
+	return number - 1, nil
+}
+
+// the number of messages and their total size, without deleted messages
+func (s *SessionState) stat() (int, int) {
+	count, size := 0, 0
+	for i, info := range s.messages {
+		if s.deleted[i] {
+			continue
+		}
+
+		count++
+		size += info.Size
+	}
+
+	return count, size
+}
+
+// UPDATE state, remove all messages marked as deleted from the mailbox
+func (s *SessionState) update() error {
+	if len(s.deleted) == 0 {
+		return nil
+	}
+
+	for index := range s.deleted {
+		if err := s.mailbox.Delete(index); err != nil {
+			return err
+		}
+	}
+
+	return s.mailbox.Commit()
 }
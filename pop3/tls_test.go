@@ -0,0 +1,180 @@
+package pop3
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a self-signed certificate for localhost
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func (c *testClient) capa() []string {
+	c.t.Helper()
+
+	if line := c.cmd("CAPA"); !strings.HasPrefix(line, OK) {
+		c.t.Fatalf("CAPA reply = %q", line)
+	}
+
+	return c.readLines()
+}
+
+// start TLS on the connection of the client
+func (c *testClient) startTLS() {
+	c.t.Helper()
+
+	conn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := conn.Handshake(); err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+}
+
+func TestSTLS(t *testing.T) {
+	s, _ := newTestServer()
+	s.TLSConfig = testTLSConfig(t)
+	s.RequireTLSForAuth = true
+
+	c := dial(t, s)
+
+	capa := c.capa()
+	if !slices.Contains(capa, "STLS") || slices.Contains(capa, "USER") {
+		t.Errorf("CAPA before STLS = %q", capa)
+	}
+
+	c.run([]step{
+		{command: "USER alice", reply: "-ERR [AUTH]"},
+		{command: "STLS", reply: OK},
+	})
+
+	c.startTLS()
+
+	capa = c.capa()
+	if slices.Contains(capa, "STLS") || !slices.Contains(capa, "USER") || !slices.Contains(capa, "SASL SCRAM-SHA-256-PLUS SCRAM-SHA-1-PLUS SCRAM-SHA-256 SCRAM-SHA-1 CRAM-MD5 PLAIN LOGIN") {
+		t.Errorf("CAPA after STLS = %q", capa)
+	}
+
+	c.run([]step{{command: "STLS", reply: ERR}})
+	c.login("alice", "secret")
+	c.run([]step{{command: "STAT", reply: "+OK 2 "}})
+}
+
+func TestSTLSRefused(t *testing.T) {
+	tests := []struct {
+		name      string
+		tlsConfig bool
+		login     bool
+	}{
+		{"without tls config", false, false},
+		{"in transaction state", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer()
+			if tt.tlsConfig {
+				s.TLSConfig = testTLSConfig(t)
+			}
+
+			c := dial(t, s)
+			if tt.login {
+				c.login("alice", "secret")
+			}
+
+			if capa := c.capa(); slices.Contains(capa, "STLS") {
+				t.Errorf("CAPA = %q", capa)
+			}
+
+			// the session goes on without TLS
+			c.run([]step{
+				{command: "STLS", reply: ERR},
+				{command: "NOOP", reply: OK},
+			})
+		})
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	s, _ := newTestServer()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ServeTLS(listener); err == nil {
+		t.Fatal("ServeTLS() without TLSConfig succeeded")
+	}
+
+	s.TLSConfig = testTLSConfig(t)
+	s.RequireTLSForAuth = true
+
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.ServeTLS(listener)
+	defer listener.Close()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the session isn't run by dial, there is nothing to wait for
+	done := make(chan struct{})
+	close(done)
+
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn), done: done}
+	defer c.close()
+
+	if greeting := c.readLine(); !strings.HasPrefix(greeting, OK) {
+		t.Fatalf("greeting = %q", greeting)
+	}
+
+	if capa := c.capa(); slices.Contains(capa, "STLS") || !slices.Contains(capa, "USER") {
+		t.Errorf("CAPA = %q", capa)
+	}
+
+	c.login("alice", "secret")
+	c.run([]step{{command: "QUIT", reply: OK}})
+}
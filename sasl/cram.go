@@ -0,0 +1,126 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const MECHANISM_CRAM_MD5 = "CRAM-MD5"
+
+// CramMD5Lookup returns the cleartext password of a user, CRAM-MD5 can't be
+// checked against a SCRAM verifier.
+type CramMD5Lookup func(username string) (password string, err error)
+
+type cramMD5Server struct {
+	hostname string
+	lookup   CramMD5Lookup
+
+	step      int
+	challenge []byte
+	username  string
+}
+
+// NewCramMD5Server returns the server of CRAM-MD5 (RFC 2195). The challenge
+// is "<random.timestamp@hostname>" and the client answers with its user name
+// and the HMAC-MD5 of the challenge keyed with the password.
+func NewCramMD5Server(hostname string, lookup CramMD5Lookup) Server {
+	return &cramMD5Server{
+		hostname: hostname,
+		lookup:   lookup,
+	}
+}
+
+func (s *cramMD5Server) Username() string {
+	if s.step != 2 {
+		return ""
+	}
+
+	return s.username
+}
+
+func (s *cramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	switch s.step {
+	case 0:
+		// the server speaks first
+		if len(response) != 0 {
+			s.step = 3
+
+			return nil, true, ErrInvalidResponse
+		}
+
+		b := make([]byte, 8)
+		rand.Read(b)
+
+		s.step = 1
+		s.challenge = []byte(fmt.Sprintf("<%d.%d@%s>", binary.BigEndian.Uint64(b)>>1, time.Now().Unix(), s.hostname))
+
+		return s.challenge, false, nil
+	case 1:
+		s.step = 3
+
+		i := strings.LastIndexByte(string(response), ' ')
+		if i <= 0 {
+			return nil, true, ErrInvalidResponse
+		}
+
+		username, digest := string(response[:i]), string(response[i+1:])
+
+		password, err := s.lookup(username)
+		if err != nil {
+			return nil, true, err
+		}
+
+		expected := hex.EncodeToString(hmacSum(md5.New, []byte(password), s.challenge))
+		if !hmac.Equal([]byte(strings.ToLower(digest)), []byte(expected)) {
+			return nil, true, ErrInvalidCredentials
+		}
+
+		s.step = 2
+		s.username = username
+
+		return nil, true, nil
+	}
+
+	return nil, true, ErrUnexpectedResponse
+}
+
+type cramMD5Client struct {
+	username string
+	password string
+	done     bool
+}
+
+// NewCramMD5Client returns the client of CRAM-MD5.
+func NewCramMD5Client(username, password string) Client {
+	return &cramMD5Client{
+		username: username,
+		password: password,
+	}
+}
+
+func (c *cramMD5Client) Start() (string, []byte, error) {
+	return MECHANISM_CRAM_MD5, nil, nil
+}
+
+func (c *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	if c.done {
+		return nil, ErrUnexpectedResponse
+	}
+
+	if len(challenge) == 0 {
+		return nil, errors.New("empty CRAM-MD5 challenge")
+	}
+
+	c.done = true
+
+	digest := hex.EncodeToString(hmacSum(md5.New, []byte(c.password), challenge))
+
+	return []byte(c.username + " " + digest), nil
+}
@@ -0,0 +1,76 @@
+package sasl
+
+import (
+	"errors"
+	"testing"
+)
+
+// the example of RFC 2195 section 2
+const (
+	rfc2195Challenge = "<1896.697170952@postoffice.reston.mci.net>"
+	rfc2195Response  = "tim b913a602c7eda7a495b4e6e7334d3890"
+)
+
+func TestCramMD5Client(t *testing.T) {
+	client := NewCramMD5Client("tim", "tanstaaftanstaaf")
+
+	mechanism, response, err := client.Start()
+	if err != nil || mechanism != MECHANISM_CRAM_MD5 || response != nil {
+		t.Fatalf("Start() = %q, %q, %v", mechanism, response, err)
+	}
+
+	response, err = client.Next([]byte(rfc2195Challenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(response) != rfc2195Response {
+		t.Errorf("response = %q, want %q", response, rfc2195Response)
+	}
+}
+
+func TestCramMD5Server(t *testing.T) {
+	lookup := func(username string) (string, error) {
+		if username != "tim" {
+			return "", ErrInvalidCredentials
+		}
+
+		return "tanstaaftanstaaf", nil
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		username string
+		err      error
+	}{
+		{"rfc 2195", rfc2195Response, "tim", nil},
+		{"upper case digest", "tim B913A602C7EDA7A495B4E6E7334D3890", "tim", nil},
+		{"wrong digest", "tim b913a602c7eda7a495b4e6e7334d3891", "", ErrInvalidCredentials},
+		{"unknown user", "tom b913a602c7eda7a495b4e6e7334d3890", "", ErrInvalidCredentials},
+		{"missing digest", "tim", "", ErrInvalidResponse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewCramMD5Server("postoffice.reston.mci.net", lookup)
+
+			challenge, done, err := server.Next(nil)
+			if err != nil || done || len(challenge) == 0 {
+				t.Fatalf("Next(nil) = %q, %v, %v", challenge, done, err)
+			}
+
+			// the challenge is random, use the one of the RFC
+			server.(*cramMD5Server).challenge = []byte(rfc2195Challenge)
+
+			_, done, err = server.Next([]byte(tt.response))
+			if !done || !errors.Is(err, tt.err) {
+				t.Fatalf("Next() = %v, %v, want true, %v", done, err, tt.err)
+			}
+
+			if got := server.Username(); got != tt.username {
+				t.Errorf("Username() = %q, want %q", got, tt.username)
+			}
+		})
+	}
+}
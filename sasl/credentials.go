@@ -0,0 +1,120 @@
+package sasl
+
+import (
+	"crypto/subtle"
+	"errors"
+	"sync"
+)
+
+// returned by a CredentialStore for a user it doesn't know
+var ErrUnknownUser = errors.New("unknown user")
+
+// Credentials are the secrets stored for a user. Password is the cleartext
+// password and may be empty when only SCRAM verifiers are stored, CRAM-MD5
+// needs the cleartext password.
+type Credentials struct {
+	Password  string
+	Verifiers []ScramVerifier
+}
+
+// CheckPassword checks the password of PLAIN and LOGIN against the cleartext
+// password or a verifier.
+func (c *Credentials) CheckPassword(password string) bool {
+	if c.Password != "" {
+		return subtle.ConstantTimeCompare([]byte(c.Password), []byte(password)) == 1
+	}
+
+	if len(c.Verifiers) == 0 {
+		return false
+	}
+
+	return c.Verifiers[0].CheckPassword(password)
+}
+
+// Verifier returns the SCRAM verifier of a user for a hash. Without a stored
+// verifier it is derived from the cleartext password, the salt stays the
+// same for the user like the salt given to unknown users.
+func (c *Credentials) Verifier(username, hashName string) (ScramVerifier, error) {
+	for _, verifier := range c.Verifiers {
+		if verifier.Hash == hashName {
+			return verifier, nil
+		}
+	}
+
+	if c.Password == "" {
+		return ScramVerifier{}, ErrInvalidCredentials
+	}
+
+	return newScramVerifier(hashName, c.Password, scramSalt(username, hashName), SCRAM_ITERATIONS)
+}
+
+// CredentialStore looks up the credentials of a user.
+type CredentialStore interface {
+	Credentials(username string) (*Credentials, error)
+}
+
+// MemoryStore is a CredentialStore kept in memory.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[string]*Credentials
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users: make(map[string]*Credentials),
+	}
+}
+
+func (m *MemoryStore) Credentials(username string) (*Credentials, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	credentials, ok := m.users[username]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+
+	return credentials, nil
+}
+
+// AddPassword stores the cleartext password of a user together with its
+// SCRAM-SHA-1 and SCRAM-SHA-256 verifiers, every mechanism can be used.
+func (m *MemoryStore) AddPassword(username, password string) error {
+	credentials := &Credentials{Password: password}
+
+	for _, hashName := range []string{"SHA-1", "SHA-256"} {
+		verifier, err := NewScramVerifier(hashName, password, SCRAM_ITERATIONS)
+		if err != nil {
+			return err
+		}
+
+		credentials.Verifiers = append(credentials.Verifiers, verifier)
+	}
+
+	m.set(username, credentials)
+
+	return nil
+}
+
+// AddVerifiers stores only the SCRAM verifiers of a user, CRAM-MD5 can't be
+// used by the user.
+func (m *MemoryStore) AddVerifiers(username string, verifiers ...ScramVerifier) {
+	m.set(username, &Credentials{Verifiers: verifiers})
+}
+
+func (m *MemoryStore) set(username string, credentials *Credentials) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users[username] = credentials
+}
+
+// CheckPassword looks up a user and checks its password.
+func CheckPassword(store CredentialStore, username, password string) bool {
+	credentials, err := store.Credentials(username)
+	if err != nil {
+		return false
+	}
+
+	return credentials.CheckPassword(password)
+}
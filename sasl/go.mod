@@ -0,0 +1,3 @@
+module github.com/radenrishwan/sasl
+
+go 1.22.4
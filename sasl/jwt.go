@@ -0,0 +1,415 @@
+package sasl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTVerifier is a TokenVerifier for JSON Web Tokens (RFC 7519) signed with
+// RS256/384/512, PS256/384/512, ES256/384/512 or EdDSA. The public keys are
+// read from a JWK Set (RFC 7517) in a local file, which is read again when it
+// changes so keys can be rotated without a restart.
+type JWTVerifier struct {
+	// file with the JWK Set of the issuer
+	KeysFile string
+	// required "iss" claim, not checked when empty
+	Issuer string
+	// required in the "aud" claim, not checked when empty
+	Audience string
+	// claim holding the user name, "sub" by default
+	UsernameClaim string
+	// allowed difference between the clocks of the issuer and the server
+	Leeway time.Duration
+
+	mu      sync.Mutex
+	modTime time.Time
+	keys    map[string]jwk
+}
+
+// a public key of the JWK Set
+type jwk struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+func NewJWTVerifier(keysFile, issuer, audience string) (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		KeysFile: keysFile,
+		Issuer:   issuer,
+		Audience: audience,
+		Leeway:   time.Minute,
+	}
+
+	// fail early when the keys can't be read
+	if _, err := v.loadKeys(); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (v *JWTVerifier) VerifyToken(token, username string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", err
+	}
+
+	keys, err := v.loadKeys()
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, key := range keys {
+		if header.Kid != "" && key.kid != header.Kid {
+			continue
+		}
+
+		if key.alg != "" && key.alg != header.Alg {
+			continue
+		}
+
+		if verifyJWTSignature(header.Alg, key.key, signed, signature) {
+			verified = true
+
+			break
+		}
+	}
+
+	if !verified {
+		return "", fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+
+	if err := v.checkClaims(claims); err != nil {
+		return "", err
+	}
+
+	claim := v.UsernameClaim
+	if claim == "" {
+		claim = "sub"
+	}
+
+	user, _ := claims[claim].(string)
+	if user == "" {
+		return "", fmt.Errorf("%w: missing %s claim", ErrInvalidToken, claim)
+	}
+
+	// the token can only be used by the user it was issued to
+	if username != "" && !strings.EqualFold(username, user) {
+		return "", fmt.Errorf("%w: token issued to another user", ErrInvalidToken)
+	}
+
+	return user, nil
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]any) error {
+	now := time.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+	}
+
+	if now.After(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+		return fmt.Errorf("%w: token expired", ErrInvalidToken)
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: token not valid yet", ErrInvalidToken)
+	}
+
+	if iss, _ := claims["iss"].(string); v.Issuer != "" && iss != v.Issuer {
+		return fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	}
+
+	if v.Audience == "" {
+		return nil
+	}
+
+	// aud is a string or an array of strings
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == v.Audience {
+			return nil
+		}
+	case []any:
+		for _, a := range aud {
+			if a == v.Audience {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+}
+
+// the keys of the file, read again when the file was modified
+func (v *JWTVerifier) loadKeys() (map[string]jwk, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	info, err := os.Stat(v.KeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTemporaryFailure, err)
+	}
+
+	if v.keys != nil && info.ModTime().Equal(v.modTime) {
+		return v.keys, nil
+	}
+
+	data, err := os.ReadFile(v.KeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTemporaryFailure, err)
+	}
+
+	keys, err := parseJWKSet(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrTemporaryFailure, v.KeysFile, err)
+	}
+
+	v.keys = keys
+	v.modTime = info.ModTime()
+
+	return keys, nil
+}
+
+func parseJWKSet(data []byte) (map[string]jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]jwk)
+	for i, k := range set.Keys {
+		// keys for encryption are skipped
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key crypto.PublicKey
+		var err error
+
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAKey(k.N, k.E)
+		case "EC":
+			key, err = parseECKey(k.Crv, k.X, k.Y)
+		case "OKP":
+			key, err = parseEd25519Key(k.Crv, k.X)
+		default:
+			err = errors.New("unsupported key type " + k.Kty)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i, err)
+		}
+
+		// keys without kid are still usable, they are tried for every token
+		id := k.Kid
+		if id == "" {
+			id = fmt.Sprintf("#%d", i)
+		}
+
+		keys[id] = jwk{kid: k.Kid, alg: k.Alg, key: key}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+
+	return keys, nil
+}
+
+func parseRSAKey(n, e string) (crypto.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}
+
+	if key.N.BitLen() < 2048 || key.E < 3 {
+		return nil, errors.New("weak RSA key")
+	}
+
+	return key, nil
+}
+
+func parseECKey(crv, x, y string) (crypto.PublicKey, error) {
+	var curve elliptic.Curve
+
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, errors.New("unsupported curve " + crv)
+	}
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xBytes),
+		Y:     new(big.Int).SetBytes(yBytes),
+	}
+
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("point is not on the curve")
+	}
+
+	return key, nil
+}
+
+func parseEd25519Key(crv, x string) (crypto.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, errors.New("unsupported curve " + crv)
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 key")
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// check the signature of a token with the key, "none" is never accepted
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) bool {
+	var h crypto.Hash
+
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		h = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		h = crypto.SHA512
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+
+		return ok && ed25519.Verify(k, signed, signature)
+	default:
+		return false
+	}
+
+	d := h.New()
+	d.Write(signed)
+	digest := d.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+
+		return ok && rsa.VerifyPKCS1v15(k, h, digest, signature) == nil
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+
+		return ok && rsa.VerifyPSS(k, h, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	}
+
+	// ES signatures are r and s of the size of the curve, RFC 7518 section 3.4
+	k, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return false
+	}
+
+	// the curve is given by the algorithm
+	bits := map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}[alg]
+	if k.Curve.Params().BitSize != bits {
+		return false
+	}
+
+	size := (bits + 7) / 8
+	if len(signature) != 2*size {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+
+	return ecdsa.Verify(k, digest, r, s)
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	return nil
+}
@@ -0,0 +1,331 @@
+package sasl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the private keys of a test issuer and their JWK Set
+type jwtIssuer struct {
+	t       *testing.T
+	p256    *ecdsa.PrivateKey
+	p384    *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+	rsa     *rsa.PrivateKey
+}
+
+func newJWTIssuer(t *testing.T) *jwtIssuer {
+	t.Helper()
+
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &jwtIssuer{t: t, p256: p256, p384: p384, ed25519: edKey, rsa: rsaKey}
+}
+
+// write the JWK Set to a file in a temporary directory
+func (i *jwtIssuer) writeKeys() string {
+	i.t.Helper()
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	ecKey := func(kid, crv string, key *ecdsa.PrivateKey) map[string]string {
+		size := (key.Curve.Params().BitSize + 7) / 8
+
+		return map[string]string{
+			"kty": "EC", "kid": kid, "crv": crv, "use": "sig",
+			"x": b64(key.X.FillBytes(make([]byte, size))),
+			"y": b64(key.Y.FillBytes(make([]byte, size))),
+		}
+	}
+
+	set := map[string]any{
+		"keys": []map[string]string{
+			ecKey("p256", "P-256", i.p256),
+			ecKey("p384", "P-384", i.p384),
+			// without kid, tried for every token
+			{"kty": "OKP", "crv": "Ed25519", "x": b64(i.ed25519.Public().(ed25519.PublicKey))},
+			{"kty": "RSA", "kid": "rsa", "n": b64(i.rsa.N.Bytes()), "e": b64(big.NewInt(int64(i.rsa.E)).Bytes())},
+			// keys for encryption are skipped
+			{"kty": "EC", "kid": "enc", "use": "enc", "crv": "P-256", "x": "", "y": ""},
+		},
+	}
+
+	data, err := json.Marshal(set)
+	if err != nil {
+		i.t.Fatal(err)
+	}
+
+	file := filepath.Join(i.t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		i.t.Fatal(err)
+	}
+
+	return file
+}
+
+// sign the claims with the key of alg
+func (i *jwtIssuer) token(alg, kid string, claims map[string]any) string {
+	i.t.Helper()
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			i.t.Fatal(err)
+		}
+
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := encode(header) + "." + encode(claims)
+
+	var signature []byte
+	var err error
+
+	switch alg {
+	case "ES256", "ES384":
+		key, h := i.p256, crypto.SHA256
+		if alg == "ES384" {
+			key, h = i.p384, crypto.SHA384
+		}
+
+		d := h.New()
+		d.Write([]byte(signed))
+
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, d.Sum(nil))
+
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	case "EdDSA":
+		signature = ed25519.Sign(i.ed25519, []byte(signed))
+	case "RS256", "PS256":
+		d := crypto.SHA256.New()
+		d.Write([]byte(signed))
+
+		if alg == "RS256" {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, i.rsa, crypto.SHA256, d.Sum(nil))
+		} else {
+			signature, err = rsa.SignPSS(rand.Reader, i.rsa, crypto.SHA256, d.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case "none":
+	default:
+		i.t.Fatalf("unsupported alg %s", alg)
+	}
+
+	if err != nil {
+		i.t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	issuer := newJWTIssuer(t)
+
+	verifier, err := NewJWTVerifier(issuer.writeKeys(), "https://issuer.example", "smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+
+	// valid claims with changes
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss": "https://issuer.example",
+			"aud": "smtp",
+			"sub": "alice",
+			"exp": now + 3600,
+			"nbf": now - 60,
+		}
+
+		for key, value := range changes {
+			if value == nil {
+				delete(c, key)
+
+				continue
+			}
+
+			c[key] = value
+		}
+
+		return c
+	}
+
+	tampered := issuer.token("ES256", "p256", claims(nil))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	tests := []struct {
+		name     string
+		token    string
+		username string
+		want     string
+		err      error
+	}{
+		{"es256", issuer.token("ES256", "p256", claims(nil)), "alice", "alice", nil},
+		{"es384", issuer.token("ES384", "p384", claims(nil)), "alice", "alice", nil},
+		{"eddsa without kid", issuer.token("EdDSA", "", claims(nil)), "alice", "alice", nil},
+		{"rs256", issuer.token("RS256", "rsa", claims(nil)), "alice", "alice", nil},
+		{"ps256", issuer.token("PS256", "rsa", claims(nil)), "alice", "alice", nil},
+		{"user from token", issuer.token("ES256", "p256", claims(nil)), "", "alice", nil},
+		{"user case insensitive", issuer.token("ES256", "p256", claims(nil)), "Alice", "alice", nil},
+		{"audience list", issuer.token("ES256", "p256", claims(map[string]any{"aud": []string{"imap", "smtp"}})), "alice", "alice", nil},
+		{"expired within leeway", issuer.token("ES256", "p256", claims(map[string]any{"exp": now - 30})), "alice", "alice", nil},
+		{"expired", issuer.token("ES256", "p256", claims(map[string]any{"exp": now - 3600})), "alice", "", ErrInvalidToken},
+		{"missing exp", issuer.token("ES256", "p256", claims(map[string]any{"exp": nil})), "alice", "", ErrInvalidToken},
+		{"not valid yet", issuer.token("ES256", "p256", claims(map[string]any{"nbf": now + 3600})), "alice", "", ErrInvalidToken},
+		{"wrong issuer", issuer.token("ES256", "p256", claims(map[string]any{"iss": "https://evil.example"})), "alice", "", ErrInvalidToken},
+		{"wrong audience", issuer.token("ES256", "p256", claims(map[string]any{"aud": []string{"imap"}})), "alice", "", ErrInvalidToken},
+		{"missing subject", issuer.token("ES256", "p256", claims(map[string]any{"sub": nil})), "alice", "", ErrInvalidToken},
+		{"other user", issuer.token("ES256", "p256", claims(nil)), "bob", "", ErrInvalidToken},
+		{"alg none", issuer.token("none", "", claims(nil)), "alice", "", ErrInvalidToken},
+		{"alg of another curve", issuer.token("ES256", "p384", claims(nil)), "alice", "", ErrInvalidToken},
+		{"unknown kid", issuer.token("ES256", "other", claims(nil)), "alice", "", ErrInvalidToken},
+		{"bad signature", tampered, "alice", "", ErrInvalidToken},
+		{"malformed", "not.a-token", "alice", "", ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifier.VerifyToken(tt.token, tt.username)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("VerifyToken() error = %v, want %v", err, tt.err)
+			}
+
+			if got != tt.want {
+				t.Errorf("VerifyToken() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierUsernameClaim(t *testing.T) {
+	issuer := newJWTIssuer(t)
+
+	verifier, err := NewJWTVerifier(issuer.writeKeys(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier.UsernameClaim = "email"
+
+	token := issuer.token("EdDSA", "", map[string]any{
+		"sub":   "1234",
+		"email": "alice@example.org",
+		"exp":   time.Now().Unix() + 3600,
+	})
+
+	got, err := verifier.VerifyToken(token, "")
+	if err != nil || got != "alice@example.org" {
+		t.Errorf("VerifyToken() = %q, %v, want %q", got, err, "alice@example.org")
+	}
+}
+
+// the keys are read again when the file changes
+func TestJWTVerifierKeyRotation(t *testing.T) {
+	old := newJWTIssuer(t)
+	file := old.writeKeys()
+
+	verifier, err := NewJWTVerifier(file, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]any{"sub": "alice", "exp": time.Now().Unix() + 3600}
+
+	if _, err := verifier.VerifyToken(old.token("ES256", "p256", claims), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newJWTIssuer(t)
+
+	data, err := os.ReadFile(rotated.writeKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the modification time may not have changed on a coarse clock
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verifier.VerifyToken(old.token("ES256", "p256", claims), ""); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token of the old key: error = %v, want %v", err, ErrInvalidToken)
+	}
+
+	if _, err := verifier.VerifyToken(rotated.token("ES256", "p256", claims), ""); err != nil {
+		t.Errorf("token of the new key: %v", err)
+	}
+
+	// a missing file is a temporary failure, not an invalid token
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verifier.VerifyToken(rotated.token("ES256", "p256", claims), ""); !errors.Is(err, ErrTemporaryFailure) {
+		t.Errorf("missing keys file: error = %v, want %v", err, ErrTemporaryFailure)
+	}
+}
+
+func TestParseJWKSetErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not json", "keys"},
+		{"no keys", `{"keys":[]}`},
+		{"only encryption keys", `{"keys":[{"kty":"RSA","use":"enc"}]}`},
+		{"unknown key type", `{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`},
+		{"unknown curve", `{"keys":[{"kty":"EC","crv":"P-192","x":"AA","y":"AA"}]}`},
+		{"point not on curve", `{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`},
+		{"weak rsa key", `{"keys":[{"kty":"RSA","n":"AQAB","e":"AQAB"}]}`},
+		{"short ed25519 key", `{"keys":[{"kty":"OKP","crv":"Ed25519","x":"AQAB"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseJWKSet([]byte(tt.data)); err == nil {
+				t.Error("parseJWKSet() succeeded")
+			}
+		})
+	}
+}
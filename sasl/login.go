@@ -0,0 +1,88 @@
+package sasl
+
+// LoginAuthenticator checks the credentials of LOGIN.
+type LoginAuthenticator func(username, password string) error
+
+type loginServer struct {
+	authenticate LoginAuthenticator
+	step         int
+	username     string
+	done         bool
+}
+
+// NewLoginServer returns the server of the obsolete LOGIN mechanism, still
+// used by many clients. The username and password are asked one after the
+// other, an initial response is taken as the username.
+func NewLoginServer(authenticate LoginAuthenticator) Server {
+	return &loginServer{authenticate: authenticate}
+}
+
+func (s *loginServer) Next(response []byte) ([]byte, bool, error) {
+	switch s.step {
+	case 0:
+		s.step++
+
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+
+		fallthrough
+	case 1:
+		s.step = 2
+		s.username = string(response)
+
+		return []byte("Password:"), false, nil
+	case 2:
+		s.step++
+
+		if err := s.authenticate(s.username, string(response)); err != nil {
+			return nil, true, err
+		}
+
+		s.done = true
+
+		return nil, true, nil
+	}
+
+	return nil, true, ErrUnexpectedResponse
+}
+
+func (s *loginServer) Username() string {
+	if !s.done {
+		return ""
+	}
+
+	return s.username
+}
+
+type loginClient struct {
+	username string
+	password string
+	step     int
+}
+
+// NewLoginClient returns the client of LOGIN, the challenges are expected in
+// the order username, password.
+func NewLoginClient(username, password string) Client {
+	return &loginClient{
+		username: username,
+		password: password,
+	}
+}
+
+func (c *loginClient) Start() (string, []byte, error) {
+	return MECHANISM_LOGIN, nil, nil
+}
+
+func (c *loginClient) Next(challenge []byte) ([]byte, error) {
+	c.step++
+
+	switch c.step {
+	case 1:
+		return []byte(c.username), nil
+	case 2:
+		return []byte(c.password), nil
+	}
+
+	return nil, ErrUnexpectedResponse
+}
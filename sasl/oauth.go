@@ -0,0 +1,228 @@
+package sasl
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	MECHANISM_OAUTHBEARER = "OAUTHBEARER"
+	MECHANISM_XOAUTH2     = "XOAUTH2"
+)
+
+var (
+	// returned by a TokenVerifier when the token is invalid or expired
+	ErrInvalidToken = errors.New("invalid token")
+	// the credentials could not be checked, e.g. the keys could not be read
+	ErrTemporaryFailure = errors.New("temporary authentication failure")
+)
+
+// TokenVerifier checks the bearer token of OAUTHBEARER and XOAUTH2.
+// username is the user named by the client, empty when it named none. The
+// authenticated user is returned, an invalid token is reported with
+// ErrInvalidToken.
+type TokenVerifier interface {
+	VerifyToken(token, username string) (string, error)
+}
+
+// TokenVerifierFunc is a function used as TokenVerifier.
+type TokenVerifierFunc func(token, username string) (string, error)
+
+func (f TokenVerifierFunc) VerifyToken(token, username string) (string, error) {
+	return f(token, username)
+}
+
+type oauthServer struct {
+	mechanism string
+	verifier  TokenVerifier
+
+	step     int
+	username string
+}
+
+// NewOAuthBearerServer returns the server of OAUTHBEARER (RFC 7628). The
+// message is "n,a=user,\x01auth=Bearer token\x01\x01", the authorization
+// identity is optional.
+func NewOAuthBearerServer(verifier TokenVerifier) Server {
+	return &oauthServer{
+		mechanism: MECHANISM_OAUTHBEARER,
+		verifier:  verifier,
+	}
+}
+
+// NewXOAuth2Server returns the server of the XOAUTH2 mechanism of Google and
+// Microsoft, the message is "user=user\x01auth=Bearer token\x01\x01".
+func NewXOAuth2Server(verifier TokenVerifier) Server {
+	return &oauthServer{
+		mechanism: MECHANISM_XOAUTH2,
+		verifier:  verifier,
+	}
+}
+
+func (s *oauthServer) Username() string {
+	if s.step != 2 {
+		return ""
+	}
+
+	return s.username
+}
+
+func (s *oauthServer) Next(response []byte) ([]byte, bool, error) {
+	switch s.step {
+	case 0:
+		if response == nil {
+			return []byte{}, false, nil
+		}
+
+		username, token, err := s.parse(string(response))
+		if err != nil {
+			s.step = 3
+
+			return nil, true, err
+		}
+
+		s.username, err = s.verifier.VerifyToken(token, username)
+		if errors.Is(err, ErrInvalidToken) {
+			s.step = 1
+
+			return s.errorChallenge(), false, nil
+		}
+
+		if err != nil {
+			s.step = 3
+
+			return nil, true, err
+		}
+
+		s.step = 2
+
+		return nil, true, nil
+	case 1:
+		// the client acknowledges the error, with "\x01" for OAUTHBEARER and an
+		// empty response for XOAUTH2
+		s.step = 3
+
+		return nil, true, ErrInvalidCredentials
+	}
+
+	return nil, true, ErrUnexpectedResponse
+}
+
+// the error sent as a challenge before the exchange fails, RFC 7628 section
+// 3.2.2
+func (s *oauthServer) errorChallenge() []byte {
+	if s.mechanism == MECHANISM_XOAUTH2 {
+		return []byte(`{"status":"401","schemes":"bearer"}`)
+	}
+
+	return []byte(`{"status":"invalid_token","schemes":"bearer"}`)
+}
+
+func (s *oauthServer) parse(message string) (username, token string, err error) {
+	if s.mechanism == MECHANISM_OAUTHBEARER {
+		// the gs2 header, channel binding is not supported
+		flag, rest, _ := strings.Cut(message, ",")
+		authzid, rest, ok := strings.Cut(rest, ",")
+		if !ok || (flag != "n" && flag != "y") || !strings.HasPrefix(rest, "\x01") {
+			return "", "", ErrInvalidResponse
+		}
+
+		if authzid != "" {
+			if !strings.HasPrefix(authzid, "a=") {
+				return "", "", ErrInvalidResponse
+			}
+
+			username, err = decodeScramName(authzid[2:])
+			if err != nil {
+				return "", "", err
+			}
+		}
+
+		message = rest[1:]
+	}
+
+	if !strings.HasSuffix(message, "\x01\x01") {
+		return "", "", ErrInvalidResponse
+	}
+
+	for _, pair := range strings.Split(strings.TrimSuffix(message, "\x01\x01"), "\x01") {
+		key, value, _ := strings.Cut(pair, "=")
+
+		switch key {
+		case "auth":
+			scheme, t, ok := strings.Cut(value, " ")
+			if !ok || !strings.EqualFold(scheme, "Bearer") {
+				return "", "", ErrInvalidResponse
+			}
+
+			token = strings.TrimSpace(t)
+		case "user":
+			if s.mechanism == MECHANISM_XOAUTH2 {
+				username = value
+			}
+		}
+	}
+
+	if token == "" || (s.mechanism == MECHANISM_XOAUTH2 && username == "") {
+		return "", "", ErrInvalidResponse
+	}
+
+	return username, token, nil
+}
+
+type oauthClient struct {
+	mechanism string
+	username  string
+	token     string
+	failed    bool
+}
+
+// NewOAuthBearerClient returns the client of OAUTHBEARER, username may be
+// empty to let the server take it from the token.
+func NewOAuthBearerClient(username, token string) Client {
+	return &oauthClient{
+		mechanism: MECHANISM_OAUTHBEARER,
+		username:  username,
+		token:     token,
+	}
+}
+
+// NewXOAuth2Client returns the client of XOAUTH2.
+func NewXOAuth2Client(username, token string) Client {
+	return &oauthClient{
+		mechanism: MECHANISM_XOAUTH2,
+		username:  username,
+		token:     token,
+	}
+}
+
+func (c *oauthClient) Start() (string, []byte, error) {
+	message := "user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"
+
+	if c.mechanism == MECHANISM_OAUTHBEARER {
+		authzid := ""
+		if c.username != "" {
+			authzid = "a=" + encodeScramName(c.username)
+		}
+
+		message = "n," + authzid + ",\x01auth=Bearer " + c.token + "\x01\x01"
+	}
+
+	return c.mechanism, []byte(message), nil
+}
+
+// the only challenge is the error of the server, it is acknowledged to get
+// the final failure
+func (c *oauthClient) Next(challenge []byte) ([]byte, error) {
+	if c.failed {
+		return nil, ErrUnexpectedResponse
+	}
+
+	c.failed = true
+
+	if c.mechanism == MECHANISM_OAUTHBEARER {
+		return []byte{1}, nil
+	}
+
+	return []byte{}, nil
+}
@@ -0,0 +1,101 @@
+package sasl
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOAuthServer(t *testing.T) {
+	verifier := TokenVerifierFunc(func(token, username string) (string, error) {
+		switch {
+		case token == "unavailable":
+			return "", ErrTemporaryFailure
+		case token != "good":
+			return "", ErrInvalidToken
+		case username != "" && username != "alice":
+			return "", ErrInvalidToken
+		}
+
+		return "alice", nil
+	})
+
+	tests := []struct {
+		name      string
+		mechanism string
+		response  string
+		username  string
+		// the error challenge is sent before the exchange fails
+		challenge string
+		err       error
+	}{
+		{"oauthbearer", MECHANISM_OAUTHBEARER, "n,a=alice,\x01auth=Bearer good\x01\x01", "alice", "", nil},
+		{"oauthbearer without user", MECHANISM_OAUTHBEARER, "n,,\x01auth=Bearer good\x01\x01", "alice", "", nil},
+		{"oauthbearer with host and port", MECHANISM_OAUTHBEARER, "n,a=alice,\x01host=mail.example.org\x01port=587\x01auth=Bearer good\x01\x01", "alice", "", nil},
+		{"oauthbearer escaped user", MECHANISM_OAUTHBEARER, "n,a=ali=2Cce,\x01auth=Bearer good\x01\x01", "", `{"status":"invalid_token","schemes":"bearer"}`, ErrInvalidCredentials},
+		{"oauthbearer bad token", MECHANISM_OAUTHBEARER, "n,a=alice,\x01auth=Bearer bad\x01\x01", "", `{"status":"invalid_token","schemes":"bearer"}`, ErrInvalidCredentials},
+		{"oauthbearer channel binding", MECHANISM_OAUTHBEARER, "p=tls-unique,,\x01auth=Bearer good\x01\x01", "", "", ErrInvalidResponse},
+		{"oauthbearer missing auth", MECHANISM_OAUTHBEARER, "n,,\x01host=mail.example.org\x01\x01", "", "", ErrInvalidResponse},
+		{"oauthbearer temporary failure", MECHANISM_OAUTHBEARER, "n,,\x01auth=Bearer unavailable\x01\x01", "", "", ErrTemporaryFailure},
+		{"xoauth2", MECHANISM_XOAUTH2, "user=alice\x01auth=Bearer good\x01\x01", "alice", "", nil},
+		{"xoauth2 other user", MECHANISM_XOAUTH2, "user=bob\x01auth=Bearer good\x01\x01", "", `{"status":"401","schemes":"bearer"}`, ErrInvalidCredentials},
+		{"xoauth2 missing user", MECHANISM_XOAUTH2, "auth=Bearer good\x01\x01", "", "", ErrInvalidResponse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewOAuthBearerServer(verifier)
+			if tt.mechanism == MECHANISM_XOAUTH2 {
+				server = NewXOAuth2Server(verifier)
+			}
+
+			challenge, done, err := server.Next([]byte(tt.response))
+			if tt.challenge != "" {
+				if err != nil || done || string(challenge) != tt.challenge {
+					t.Fatalf("Next() = %q, %v, %v, want %q", challenge, done, err, tt.challenge)
+				}
+
+				// the client acknowledges the error
+				_, done, err = server.Next([]byte{1})
+			}
+
+			if !done || !errors.Is(err, tt.err) {
+				t.Fatalf("Next() = %v, %v, want true, %v", done, err, tt.err)
+			}
+
+			if got := server.Username(); got != tt.username {
+				t.Errorf("Username() = %q, want %q", got, tt.username)
+			}
+		})
+	}
+}
+
+func TestOAuthClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   Client
+		response string
+		ack      string
+	}{
+		{"oauthbearer", NewOAuthBearerClient("alice", "token"), "n,a=alice,\x01auth=Bearer token\x01\x01", "\x01"},
+		{"oauthbearer without user", NewOAuthBearerClient("", "token"), "n,,\x01auth=Bearer token\x01\x01", "\x01"},
+		{"xoauth2", NewXOAuth2Client("alice", "token"), "user=alice\x01auth=Bearer token\x01\x01", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, response, err := tt.client.Start()
+			if err != nil || string(response) != tt.response {
+				t.Fatalf("Start() = %q, %v, want %q", response, err, tt.response)
+			}
+
+			ack, err := tt.client.Next([]byte(`{"status":"invalid_token"}`))
+			if err != nil || string(ack) != tt.ack {
+				t.Fatalf("Next() = %q, %v, want %q", ack, err, tt.ack)
+			}
+
+			if _, err := tt.client.Next(nil); err == nil {
+				t.Error("second challenge accepted")
+			}
+		})
+	}
+}
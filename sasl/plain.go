@@ -0,0 +1,72 @@
+package sasl
+
+import "bytes"
+
+// PlainAuthenticator checks the credentials of PLAIN, identity is the
+// authorization identity and empty when the client didn't send one.
+type PlainAuthenticator func(identity, username, password string) error
+
+type plainServer struct {
+	authenticate PlainAuthenticator
+	done         bool
+	username     string
+}
+
+// NewPlainServer returns the server of PLAIN (RFC 4616), the message is
+// "identity\x00username\x00password".
+func NewPlainServer(authenticate PlainAuthenticator) Server {
+	return &plainServer{authenticate: authenticate}
+}
+
+func (s *plainServer) Next(response []byte) ([]byte, bool, error) {
+	if s.done {
+		return nil, true, ErrUnexpectedResponse
+	}
+
+	// no initial response, ask for it with an empty challenge
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	s.done = true
+
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return nil, true, ErrInvalidResponse
+	}
+
+	if err := s.authenticate(string(parts[0]), string(parts[1]), string(parts[2])); err != nil {
+		return nil, true, err
+	}
+
+	s.username = string(parts[1])
+
+	return nil, true, nil
+}
+
+func (s *plainServer) Username() string {
+	return s.username
+}
+
+type plainClient struct {
+	identity string
+	username string
+	password string
+}
+
+// NewPlainClient returns the client of PLAIN, identity is usually empty.
+func NewPlainClient(identity, username, password string) Client {
+	return &plainClient{
+		identity: identity,
+		username: username,
+		password: password,
+	}
+}
+
+func (c *plainClient) Start() (string, []byte, error) {
+	return MECHANISM_PLAIN, []byte(c.identity + "\x00" + c.username + "\x00" + c.password), nil
+}
+
+func (c *plainClient) Next(challenge []byte) ([]byte, error) {
+	return nil, ErrUnexpectedResponse
+}
@@ -0,0 +1,202 @@
+// Package sasl implements SASL mechanisms (RFC 4422) for the SMTP and POP3
+// servers and the SMTP client.
+package sasl
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+)
+
+const (
+	MECHANISM_PLAIN = "PLAIN"
+	MECHANISM_LOGIN = "LOGIN"
+)
+
+var (
+	// returned by an authenticator when the credentials are wrong
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// the client sent a response that doesn't fit the mechanism
+	ErrInvalidResponse = errors.New("invalid response")
+	// Next was called after the exchange was done
+	ErrUnexpectedResponse = errors.New("unexpected response")
+	// the mechanism is not implemented
+	ErrUnknownMechanism = errors.New("unknown mechanism")
+)
+
+// Server is the server side of a mechanism. The protocol sends the
+// challenges to the client and passes its responses to Next.
+type Server interface {
+	// Next is first called with the initial response of the client, nil
+	// when the client sent none. The exchange is finished when done is true,
+	// a challenge returned with done is additional data sent with the
+	// success.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// Username is the authenticated user, empty until the exchange succeeded
+	Username() string
+}
+
+// Client is the client side of a mechanism.
+type Client interface {
+	// Start returns the name of the mechanism and the initial response, nil
+	// when the mechanism has none.
+	Start() (mechanism string, response []byte, err error)
+	// Next returns the response to a challenge of the server.
+	Next(challenge []byte) (response []byte, err error)
+}
+
+// ChannelBinding binds a SCRAM exchange to the TLS connection it runs on
+// (RFC 5929, RFC 9266), used by the -PLUS mechanisms.
+type ChannelBinding struct {
+	// tls-unique or tls-exporter
+	Type string
+	Data []byte
+}
+
+// TLSChannelBinding returns the channel binding of a TLS connection,
+// tls-exporter for TLS 1.3 and tls-unique for older versions.
+func TLSChannelBinding(state tls.ConnectionState) (*ChannelBinding, error) {
+	if state.Version >= tls.VersionTLS13 {
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ChannelBinding{Type: "tls-exporter", Data: data}, nil
+	}
+
+	if len(state.TLSUnique) == 0 {
+		return nil, errors.New("connection has no tls-unique channel binding")
+	}
+
+	return &ChannelBinding{Type: "tls-unique", Data: state.TLSUnique}, nil
+}
+
+// Mechanisms returns the mechanisms supported by NewServer with opts,
+// strongest first. The -PLUS mechanisms are only included with a channel
+// binding, OAUTHBEARER and XOAUTH2 with a token verifier.
+func Mechanisms(opts ServerOptions) []string {
+	var mechanisms []string
+	if opts.ChannelBinding != nil {
+		mechanisms = append(mechanisms, MECHANISM_SCRAM_SHA_256_PLUS, MECHANISM_SCRAM_SHA_1_PLUS)
+	}
+
+	mechanisms = append(mechanisms, MECHANISM_SCRAM_SHA_256, MECHANISM_SCRAM_SHA_1)
+
+	if opts.TokenVerifier != nil {
+		mechanisms = append(mechanisms, MECHANISM_OAUTHBEARER, MECHANISM_XOAUTH2)
+	}
+
+	return append(mechanisms, MECHANISM_CRAM_MD5, MECHANISM_PLAIN, MECHANISM_LOGIN)
+}
+
+// ServerOptions are passed to NewServer.
+type ServerOptions struct {
+	// host name used in the CRAM-MD5 challenge
+	Hostname string
+	// channel binding of the connection, nil without TLS
+	ChannelBinding *ChannelBinding
+	// checks the tokens of OAUTHBEARER and XOAUTH2, they are not supported
+	// when nil
+	TokenVerifier TokenVerifier
+}
+
+// NewServer returns the server of a mechanism checking the credentials of
+// store. The authorization identity has to be empty or the user name.
+func NewServer(mechanism string, store CredentialStore, opts ServerOptions) (Server, error) {
+	lookup := func(username string) (*Credentials, error) {
+		credentials, err := store.Credentials(username)
+		if errors.Is(err, ErrUnknownUser) {
+			return nil, ErrInvalidCredentials
+		}
+
+		return credentials, err
+	}
+
+	checkPassword := func(username, password string) error {
+		credentials, err := lookup(username)
+		if err != nil {
+			return err
+		}
+
+		if !credentials.CheckPassword(password) {
+			return ErrInvalidCredentials
+		}
+
+		return nil
+	}
+
+	mechanism = strings.ToUpper(mechanism)
+
+	switch mechanism {
+	case MECHANISM_PLAIN:
+		return NewPlainServer(func(identity, username, password string) error {
+			// acting as another user is not supported
+			if identity != "" && identity != username {
+				return ErrInvalidCredentials
+			}
+
+			return checkPassword(username, password)
+		}), nil
+	case MECHANISM_LOGIN:
+		return NewLoginServer(checkPassword), nil
+	case MECHANISM_CRAM_MD5:
+		return NewCramMD5Server(opts.Hostname, func(username string) (string, error) {
+			credentials, err := lookup(username)
+			if err != nil {
+				return "", err
+			}
+
+			if credentials.Password == "" {
+				return "", ErrInvalidCredentials
+			}
+
+			return credentials.Password, nil
+		}), nil
+	case MECHANISM_SCRAM_SHA_1, MECHANISM_SCRAM_SHA_256, MECHANISM_SCRAM_SHA_1_PLUS, MECHANISM_SCRAM_SHA_256_PLUS:
+		return NewScramServer(mechanism, func(username, hashName string) (ScramVerifier, error) {
+			credentials, err := lookup(username)
+			if err != nil {
+				return ScramVerifier{}, err
+			}
+
+			return credentials.Verifier(username, hashName)
+		}, opts.ChannelBinding)
+	case MECHANISM_OAUTHBEARER, MECHANISM_XOAUTH2:
+		if opts.TokenVerifier == nil {
+			return nil, ErrUnknownMechanism
+		}
+
+		if mechanism == MECHANISM_XOAUTH2 {
+			return NewXOAuth2Server(opts.TokenVerifier), nil
+		}
+
+		return NewOAuthBearerServer(opts.TokenVerifier), nil
+	}
+
+	return nil, ErrUnknownMechanism
+}
+
+// NewClient returns the client of a mechanism, cb is the channel binding of
+// the connection and nil without TLS. The password of OAUTHBEARER and
+// XOAUTH2 is the bearer token.
+func NewClient(mechanism, username, password string, cb *ChannelBinding) (Client, error) {
+	mechanism = strings.ToUpper(mechanism)
+
+	switch mechanism {
+	case MECHANISM_PLAIN:
+		return NewPlainClient("", username, password), nil
+	case MECHANISM_LOGIN:
+		return NewLoginClient(username, password), nil
+	case MECHANISM_CRAM_MD5:
+		return NewCramMD5Client(username, password), nil
+	case MECHANISM_SCRAM_SHA_1, MECHANISM_SCRAM_SHA_256, MECHANISM_SCRAM_SHA_1_PLUS, MECHANISM_SCRAM_SHA_256_PLUS:
+		return NewScramClient(mechanism, username, password, cb)
+	case MECHANISM_OAUTHBEARER:
+		return NewOAuthBearerClient(username, password), nil
+	case MECHANISM_XOAUTH2:
+		return NewXOAuth2Client(username, password), nil
+	}
+
+	return nil, ErrUnknownMechanism
+}
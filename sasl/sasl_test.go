@@ -0,0 +1,172 @@
+package sasl
+
+import (
+	"errors"
+	"testing"
+)
+
+// run an exchange like the SMTP and POP3 servers do, an empty challenge
+// with done ends it
+func runExchange(client Client, server Server) error {
+	_, response, err := client.Start()
+	if err != nil {
+		return err
+	}
+
+	for {
+		challenge, done, err := server.Next(response)
+		if err != nil {
+			return err
+		}
+
+		if done && len(challenge) == 0 {
+			return nil
+		}
+
+		response, err = client.Next(challenge)
+		if err != nil {
+			return err
+		}
+
+		if done {
+			if len(response) != 0 {
+				return ErrUnexpectedResponse
+			}
+
+			return nil
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.AddPassword("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a user with SCRAM verifiers only, CRAM-MD5 needs the cleartext password
+	verifier, err := NewScramVerifier("SHA-256", "hunter2", SCRAM_ITERATIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.AddVerifiers("bob", verifier)
+
+	cb := &ChannelBinding{Type: "tls-exporter", Data: []byte("exported keying material")}
+
+	tests := []struct {
+		name      string
+		mechanism string
+		username  string
+		password  string
+		cb        *ChannelBinding
+		err       error
+	}{
+		{"plain", MECHANISM_PLAIN, "alice", "secret", nil, nil},
+		{"plain wrong password", MECHANISM_PLAIN, "alice", "wrong", nil, ErrInvalidCredentials},
+		{"plain unknown user", MECHANISM_PLAIN, "mallory", "secret", nil, ErrInvalidCredentials},
+		{"login", MECHANISM_LOGIN, "alice", "secret", nil, nil},
+		{"login wrong password", MECHANISM_LOGIN, "alice", "wrong", nil, ErrInvalidCredentials},
+		{"cram-md5", MECHANISM_CRAM_MD5, "alice", "secret", nil, nil},
+		{"cram-md5 wrong password", MECHANISM_CRAM_MD5, "alice", "wrong", nil, ErrInvalidCredentials},
+		{"cram-md5 without cleartext password", MECHANISM_CRAM_MD5, "bob", "hunter2", nil, ErrInvalidCredentials},
+		{"scram-sha-1", MECHANISM_SCRAM_SHA_1, "alice", "secret", nil, nil},
+		{"scram-sha-256", MECHANISM_SCRAM_SHA_256, "alice", "secret", nil, nil},
+		{"scram-sha-256 stored verifier", MECHANISM_SCRAM_SHA_256, "bob", "hunter2", nil, nil},
+		{"scram-sha-1 without verifier", MECHANISM_SCRAM_SHA_1, "bob", "hunter2", nil, ErrInvalidCredentials},
+		{"scram-sha-256 wrong password", MECHANISM_SCRAM_SHA_256, "alice", "wrong", nil, ErrInvalidCredentials},
+		{"scram-sha-256 unknown user", MECHANISM_SCRAM_SHA_256, "mallory", "secret", nil, ErrInvalidCredentials},
+		{"scram-sha-1-plus", MECHANISM_SCRAM_SHA_1_PLUS, "alice", "secret", cb, nil},
+		{"scram-sha-256-plus", MECHANISM_SCRAM_SHA_256_PLUS, "alice", "secret", cb, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := NewServer(tt.mechanism, store, ServerOptions{Hostname: "mail.example.org", ChannelBinding: tt.cb})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, err := NewClient(tt.mechanism, tt.username, tt.password, tt.cb)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = runExchange(client, server)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("exchange error = %v, want %v", err, tt.err)
+			}
+
+			want := tt.username
+			if tt.err != nil {
+				want = ""
+			}
+
+			if got := server.Username(); got != want {
+				t.Errorf("Username() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPlainServer(t *testing.T) {
+	authenticate := func(identity, username, password string) error {
+		if identity != "" && identity != username || username != "alice" || password != "secret" {
+			return ErrInvalidCredentials
+		}
+
+		return nil
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		username string
+		err      error
+	}{
+		{"without identity", "\x00alice\x00secret", "alice", nil},
+		{"with identity", "alice\x00alice\x00secret", "alice", nil},
+		{"other identity", "root\x00alice\x00secret", "", ErrInvalidCredentials},
+		{"wrong password", "\x00alice\x00wrong", "", ErrInvalidCredentials},
+		{"empty user name", "\x00\x00secret", "", ErrInvalidResponse},
+		{"missing password", "\x00alice", "", ErrInvalidResponse},
+		{"too many fields", "\x00alice\x00secret\x00", "", ErrInvalidResponse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewPlainServer(authenticate)
+
+			_, done, err := server.Next([]byte(tt.response))
+			if !done || !errors.Is(err, tt.err) {
+				t.Fatalf("Next() = %v, %v, want true, %v", done, err, tt.err)
+			}
+
+			if got := server.Username(); got != tt.username {
+				t.Errorf("Username() = %q, want %q", got, tt.username)
+			}
+		})
+	}
+}
+
+func TestNewServerUnknownMechanism(t *testing.T) {
+	store := NewMemoryStore()
+
+	tests := []struct {
+		name      string
+		mechanism string
+		opts      ServerOptions
+	}{
+		{"unknown", "DIGEST-MD5", ServerOptions{}},
+		{"oauth without verifier", MECHANISM_OAUTHBEARER, ServerOptions{}},
+		{"xoauth2 without verifier", MECHANISM_XOAUTH2, ServerOptions{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewServer(tt.mechanism, store, tt.opts); !errors.Is(err, ErrUnknownMechanism) {
+				t.Errorf("NewServer(%q) error = %v, want %v", tt.mechanism, err, ErrUnknownMechanism)
+			}
+		})
+	}
+}
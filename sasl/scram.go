@@ -0,0 +1,596 @@
+package sasl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const (
+	MECHANISM_SCRAM_SHA_1        = "SCRAM-SHA-1"
+	MECHANISM_SCRAM_SHA_1_PLUS   = "SCRAM-SHA-1-PLUS"
+	MECHANISM_SCRAM_SHA_256      = "SCRAM-SHA-256"
+	MECHANISM_SCRAM_SHA_256_PLUS = "SCRAM-SHA-256-PLUS"
+
+	// iteration count of new verifiers, the minimum of RFC 7677
+	SCRAM_ITERATIONS = 4096
+)
+
+// ScramVerifier is what the server stores of a password for SCRAM (RFC 5802),
+// the password can't be recovered from it.
+type ScramVerifier struct {
+	// SHA-1 or SHA-256
+	Hash       string
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramVerifier derives the verifier of a password with a random salt.
+func NewScramVerifier(hashName, password string, iterations int) (ScramVerifier, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return ScramVerifier{}, err
+	}
+
+	return newScramVerifier(hashName, password, salt, iterations)
+}
+
+func newScramVerifier(hashName, password string, salt []byte, iterations int) (ScramVerifier, error) {
+	h, err := scramHash(hashName)
+	if err != nil {
+		return ScramVerifier{}, err
+	}
+
+	if iterations < 1 {
+		return ScramVerifier{}, errors.New("invalid iteration count")
+	}
+
+	salted := pbkdf2(h, []byte(password), salt, iterations)
+
+	return ScramVerifier{
+		Hash:       hashName,
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  hashSum(h, hmacSum(h, salted, []byte("Client Key"))),
+		ServerKey:  hmacSum(h, salted, []byte("Server Key")),
+	}, nil
+}
+
+// CheckPassword compares a password with the verifier, used for PLAIN and
+// LOGIN when the password itself is not stored.
+func (v ScramVerifier) CheckPassword(password string) bool {
+	check, err := newScramVerifier(v.Hash, password, v.Salt, v.Iterations)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(check.StoredKey, v.StoredKey)
+}
+
+// String encodes the verifier like the userPassword attribute of RFC 5803,
+// SCRAM-SHA-256$<iterations>:<salt>$<stored key>:<server key>.
+func (v ScramVerifier) String() string {
+	b64 := base64.StdEncoding.EncodeToString
+
+	return fmt.Sprintf("SCRAM-%s$%d:%s$%s:%s", v.Hash, v.Iterations, b64(v.Salt), b64(v.StoredKey), b64(v.ServerKey))
+}
+
+// ParseScramVerifier decodes a verifier encoded with String.
+func ParseScramVerifier(s string) (ScramVerifier, error) {
+	errInvalid := errors.New("invalid SCRAM verifier")
+
+	parts := strings.Split(s, "$")
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "SCRAM-") {
+		return ScramVerifier{}, errInvalid
+	}
+
+	v := ScramVerifier{Hash: strings.TrimPrefix(parts[0], "SCRAM-")}
+
+	h, err := scramHash(v.Hash)
+	if err != nil {
+		return ScramVerifier{}, err
+	}
+
+	iterations, salt, ok1 := strings.Cut(parts[1], ":")
+	storedKey, serverKey, ok2 := strings.Cut(parts[2], ":")
+	if !ok1 || !ok2 {
+		return ScramVerifier{}, errInvalid
+	}
+
+	v.Iterations, err = strconv.Atoi(iterations)
+	if err != nil || v.Iterations < 1 {
+		return ScramVerifier{}, errInvalid
+	}
+
+	for _, field := range []struct {
+		value string
+		dst   *[]byte
+	}{{salt, &v.Salt}, {storedKey, &v.StoredKey}, {serverKey, &v.ServerKey}} {
+		*field.dst, err = base64.StdEncoding.DecodeString(field.value)
+		if err != nil {
+			return ScramVerifier{}, errInvalid
+		}
+	}
+
+	if len(v.StoredKey) != h().Size() || len(v.ServerKey) != h().Size() {
+		return ScramVerifier{}, errInvalid
+	}
+
+	return v, nil
+}
+
+// ScramVerifierLookup returns the verifier of a user for the hash of the
+// mechanism, SHA-1 or SHA-256. For ErrUnknownUser and ErrInvalidCredentials
+// the exchange goes on with a fake salt and fails at the client-final message
+// like a wrong password, so the user can't be told apart from a known one.
+type ScramVerifierLookup func(username, hashName string) (ScramVerifier, error)
+
+type scramServer struct {
+	hashName string
+	hash     func() hash.Hash
+	plus     bool
+	// channel binding of the connection, nil without TLS
+	cb     *ChannelBinding
+	lookup ScramVerifierLookup
+
+	step            int
+	username        string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	verifier        ScramVerifier
+}
+
+// NewScramServer returns the server of a SCRAM mechanism (RFC 5802, RFC
+// 7677). cb is the channel binding of the TLS connection, it is required by
+// the -PLUS mechanisms and used by the others to detect a downgrade.
+func NewScramServer(mechanism string, lookup ScramVerifierLookup, cb *ChannelBinding) (Server, error) {
+	hashName, plus, err := parseScramMechanism(mechanism)
+	if err != nil {
+		return nil, err
+	}
+
+	if plus && cb == nil {
+		return nil, errors.New(mechanism + " requires channel binding")
+	}
+
+	h, _ := scramHash(hashName)
+
+	return &scramServer{
+		hashName: hashName,
+		hash:     h,
+		plus:     plus,
+		cb:       cb,
+		lookup:   lookup,
+	}, nil
+}
+
+func (s *scramServer) Username() string {
+	if s.step != 2 {
+		return ""
+	}
+
+	return s.username
+}
+
+func (s *scramServer) Next(response []byte) ([]byte, bool, error) {
+	switch s.step {
+	case 0:
+		if response == nil {
+			return []byte{}, false, nil
+		}
+
+		challenge, err := s.clientFirst(string(response))
+		if err != nil {
+			s.step = 3
+
+			return nil, true, err
+		}
+
+		s.step = 1
+
+		return challenge, false, nil
+	case 1:
+		challenge, err := s.clientFinal(string(response))
+		if err != nil {
+			s.step = 3
+
+			return nil, true, err
+		}
+
+		s.step = 2
+
+		return challenge, true, nil
+	}
+
+	return nil, true, ErrUnexpectedResponse
+}
+
+func (s *scramServer) clientFirst(message string) ([]byte, error) {
+	// gs2-header is "cbind-flag,[a=authzid],"
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return nil, ErrInvalidResponse
+	}
+
+	flag, authzid := parts[0], parts[1]
+
+	switch {
+	case strings.HasPrefix(flag, "p="):
+		if !s.plus || flag[2:] != s.cb.Type {
+			return nil, ErrInvalidResponse
+		}
+	case flag == "y":
+		// the client supports channel binding but thinks the server doesn't
+		if s.cb != nil {
+			return nil, ErrInvalidCredentials
+		}
+	case flag == "n":
+		if s.plus {
+			return nil, ErrInvalidResponse
+		}
+	default:
+		return nil, ErrInvalidResponse
+	}
+
+	s.gs2Header = flag + "," + authzid + ","
+	s.clientFirstBare = parts[2]
+
+	attrs := strings.Split(s.clientFirstBare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || attrs[1] == "r=" {
+		return nil, ErrInvalidResponse
+	}
+
+	username, err := decodeScramName(attrs[0][2:])
+	if err != nil || username == "" {
+		return nil, ErrInvalidResponse
+	}
+
+	// acting as another user is not supported
+	if authzid != "" {
+		identity, err := decodeScramName(strings.TrimPrefix(authzid, "a="))
+		if err != nil || !strings.HasPrefix(authzid, "a=") || identity != username {
+			return nil, ErrInvalidCredentials
+		}
+	}
+
+	s.username = username
+
+	s.verifier, err = s.lookup(username, s.hashName)
+	if errors.Is(err, ErrUnknownUser) || errors.Is(err, ErrInvalidCredentials) {
+		s.verifier, err = fakeScramVerifier(username, s.hashName)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.nonce = attrs[1][2:] + randomNonce()
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(s.verifier.Salt), s.verifier.Iterations)
+
+	return []byte(s.serverFirst), nil
+}
+
+func (s *scramServer) clientFinal(message string) ([]byte, error) {
+	i := strings.LastIndex(message, ",p=")
+	if i < 0 {
+		return nil, ErrInvalidResponse
+	}
+
+	withoutProof := message[:i]
+
+	proof, err := base64.StdEncoding.DecodeString(message[i+3:])
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || attrs[1] != "r="+s.nonce {
+		return nil, ErrInvalidResponse
+	}
+
+	binding := []byte(s.gs2Header)
+	if s.plus {
+		binding = append(binding, s.cb.Data...)
+	}
+
+	if attrs[0][2:] != base64.StdEncoding.EncodeToString(binding) {
+		return nil, ErrInvalidCredentials
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+
+	signature := hmacSum(s.hash, s.verifier.StoredKey, authMessage)
+	if len(proof) != len(signature) {
+		return nil, ErrInvalidCredentials
+	}
+
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ signature[i]
+	}
+
+	if subtle.ConstantTimeCompare(hashSum(s.hash, clientKey), s.verifier.StoredKey) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+
+	serverSignature := hmacSum(s.hash, s.verifier.ServerKey, authMessage)
+
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// key of the salts derived by the server, random for every process
+var scramSaltKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	return key
+}()
+
+// the salt of a user without a stored verifier, it is the same for every
+// exchange so it doesn't tell whether the user exists
+func scramSalt(username, hashName string) []byte {
+	return hmacSum(sha256.New, scramSaltKey, []byte(hashName+"\x00"+username))[:16]
+}
+
+// the verifier of an unknown user, it has random keys so no proof matches
+func fakeScramVerifier(username, hashName string) (ScramVerifier, error) {
+	h, err := scramHash(hashName)
+	if err != nil {
+		return ScramVerifier{}, err
+	}
+
+	verifier := ScramVerifier{
+		Hash:       hashName,
+		Salt:       scramSalt(username, hashName),
+		Iterations: SCRAM_ITERATIONS,
+		StoredKey:  make([]byte, h().Size()),
+		ServerKey:  make([]byte, h().Size()),
+	}
+
+	if _, err := rand.Read(verifier.StoredKey); err != nil {
+		return ScramVerifier{}, err
+	}
+
+	if _, err := rand.Read(verifier.ServerKey); err != nil {
+		return ScramVerifier{}, err
+	}
+
+	return verifier, nil
+}
+
+type scramClient struct {
+	mechanism string
+	hash      func() hash.Hash
+	username  string
+	password  string
+	cb        *ChannelBinding
+	plus      bool
+
+	step            int
+	gs2Header       string
+	clientFirstBare string
+	nonce           string
+	serverSignature []byte
+}
+
+// NewScramClient returns the client of a SCRAM mechanism. cb is the channel
+// binding of the TLS connection, required by the -PLUS mechanisms.
+func NewScramClient(mechanism, username, password string, cb *ChannelBinding) (Client, error) {
+	hashName, plus, err := parseScramMechanism(mechanism)
+	if err != nil {
+		return nil, err
+	}
+
+	if plus && cb == nil {
+		return nil, errors.New(mechanism + " requires channel binding")
+	}
+
+	h, _ := scramHash(hashName)
+
+	return &scramClient{
+		mechanism: mechanism,
+		hash:      h,
+		username:  username,
+		password:  password,
+		cb:        cb,
+		plus:      plus,
+	}, nil
+}
+
+func (c *scramClient) Start() (string, []byte, error) {
+	switch {
+	case c.plus:
+		c.gs2Header = "p=" + c.cb.Type + ",,"
+	case c.cb != nil:
+		// supported by the client, but not offered by the server
+		c.gs2Header = "y,,"
+	default:
+		c.gs2Header = "n,,"
+	}
+
+	c.nonce = randomNonce()
+	c.clientFirstBare = "n=" + encodeScramName(c.username) + ",r=" + c.nonce
+
+	return c.mechanism, []byte(c.gs2Header + c.clientFirstBare), nil
+}
+
+func (c *scramClient) Next(challenge []byte) ([]byte, error) {
+	c.step++
+
+	switch c.step {
+	case 1:
+		return c.clientFinal(string(challenge))
+	case 2:
+		message := string(challenge)
+		if strings.HasPrefix(message, "e=") {
+			return nil, errors.New("server error: " + message[2:])
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(message, "v="))
+		if err != nil || !strings.HasPrefix(message, "v=") || !hmac.Equal(signature, c.serverSignature) {
+			return nil, errors.New("invalid server signature")
+		}
+
+		return []byte{}, nil
+	}
+
+	return nil, ErrUnexpectedResponse
+}
+
+func (c *scramClient) clientFinal(serverFirst string) ([]byte, error) {
+	var nonce, salt string
+	iterations := 0
+
+	for _, attr := range strings.Split(serverFirst, ",") {
+		key, value, _ := strings.Cut(attr, "=")
+
+		switch key {
+		case "r":
+			nonce = value
+		case "s":
+			salt = value
+		case "i":
+			iterations, _ = strconv.Atoi(value)
+		case "m":
+			return nil, errors.New("unsupported mandatory extension")
+		}
+	}
+
+	decodedSalt, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) || iterations < 1 {
+		return nil, errors.New("invalid server challenge")
+	}
+
+	binding := []byte(c.gs2Header)
+	if c.plus {
+		binding = append(binding, c.cb.Data...)
+	}
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(binding) + ",r=" + nonce
+	authMessage := []byte(c.clientFirstBare + "," + serverFirst + "," + withoutProof)
+
+	salted := pbkdf2(c.hash, []byte(c.password), decodedSalt, iterations)
+	clientKey := hmacSum(c.hash, salted, []byte("Client Key"))
+	storedKey := hashSum(c.hash, clientKey)
+
+	signature := hmacSum(c.hash, storedKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+
+	c.serverSignature = hmacSum(c.hash, hmacSum(c.hash, salted, []byte("Server Key")), authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func parseScramMechanism(mechanism string) (hashName string, plus bool, err error) {
+	switch strings.ToUpper(mechanism) {
+	case MECHANISM_SCRAM_SHA_1:
+		return "SHA-1", false, nil
+	case MECHANISM_SCRAM_SHA_1_PLUS:
+		return "SHA-1", true, nil
+	case MECHANISM_SCRAM_SHA_256:
+		return "SHA-256", false, nil
+	case MECHANISM_SCRAM_SHA_256_PLUS:
+		return "SHA-256", true, nil
+	}
+
+	return "", false, errors.New("unknown SCRAM mechanism " + mechanism)
+}
+
+func scramHash(name string) (func() hash.Hash, error) {
+	switch name {
+	case "SHA-1":
+		return sha1.New, nil
+	case "SHA-256":
+		return sha256.New, nil
+	}
+
+	return nil, errors.New("unsupported hash " + name)
+}
+
+// "," and "=" in a user name are encoded as "=2C" and "=3D"
+func encodeScramName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+func decodeScramName(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", ErrInvalidResponse
+		}
+
+		i += 2
+	}
+
+	return b.String(), nil
+}
+
+func randomNonce() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func hmacSum(h func() hash.Hash, key, message []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(message)
+
+	return mac.Sum(nil)
+}
+
+func hashSum(h func() hash.Hash, message []byte) []byte {
+	d := h()
+	d.Write(message)
+
+	return d.Sum(nil)
+}
+
+// PBKDF2 with HMAC (RFC 8018) with the output size of the hash, Hi() of RFC
+// 5802
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	result := bytes.Clone(u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,283 @@
+package sasl
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// the exchanges of RFC 5802 section 5 and RFC 7677 section 3, user "user"
+// with password "pencil"
+var scramVectors = []struct {
+	mechanism   string
+	hashName    string
+	clientNonce string
+	salt        string
+	clientFirst string
+	serverFirst string
+	clientFinal string
+	serverFinal string
+}{
+	{
+		mechanism:   MECHANISM_SCRAM_SHA_1,
+		hashName:    "SHA-1",
+		clientNonce: "fyko+d2lbbFgONRv9qkxdawL",
+		salt:        "QSXCR+Q6sek8bf92",
+		clientFirst: "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+		serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	},
+	{
+		mechanism:   MECHANISM_SCRAM_SHA_256,
+		hashName:    "SHA-256",
+		clientNonce: "rOprNGfwEbeRWgbNEkqO",
+		salt:        "W22ZaJ0SNY7soEsUEjb6gQ==",
+		clientFirst: "n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	},
+}
+
+func TestScramClientVectors(t *testing.T) {
+	for _, v := range scramVectors {
+		t.Run(v.mechanism, func(t *testing.T) {
+			client, err := NewScramClient(v.mechanism, "user", "pencil", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := client.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the nonce is random, use the one of the RFC
+			c := client.(*scramClient)
+			c.nonce = v.clientNonce
+			c.clientFirstBare = strings.TrimPrefix(v.clientFirst, "n,,")
+
+			response, err := client.Next([]byte(v.serverFirst))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(response) != v.clientFinal {
+				t.Errorf("client-final = %q, want %q", response, v.clientFinal)
+			}
+
+			if _, err := client.Next([]byte(v.serverFinal)); err != nil {
+				t.Errorf("server-final rejected: %v", err)
+			}
+		})
+	}
+}
+
+func TestScramServerVectors(t *testing.T) {
+	for _, v := range scramVectors {
+		t.Run(v.mechanism, func(t *testing.T) {
+			salt, _ := base64.StdEncoding.DecodeString(v.salt)
+
+			verifier, err := newScramVerifier(v.hashName, "pencil", salt, 4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server, err := NewScramServer(v.mechanism, func(username, hashName string) (ScramVerifier, error) {
+				if username != "user" || hashName != v.hashName {
+					return ScramVerifier{}, ErrUnknownUser
+				}
+
+				return verifier, nil
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := server.Next([]byte(v.clientFirst)); err != nil {
+				t.Fatal(err)
+			}
+
+			// the nonce is random, use the one of the RFC
+			s := server.(*scramServer)
+			s.nonce = strings.TrimPrefix(strings.Split(v.serverFirst, ",")[0], "r=")
+			s.serverFirst = v.serverFirst
+
+			challenge, done, err := server.Next([]byte(v.clientFinal))
+			if err != nil || !done {
+				t.Fatalf("Next() = %q, %v, %v", challenge, done, err)
+			}
+
+			if string(challenge) != v.serverFinal {
+				t.Errorf("server-final = %q, want %q", challenge, v.serverFinal)
+			}
+
+			if got := server.Username(); got != "user" {
+				t.Errorf("Username() = %q, want %q", got, "user")
+			}
+		})
+	}
+}
+
+func TestScramServerErrors(t *testing.T) {
+	verifier, err := NewScramVerifier("SHA-256", "pencil", SCRAM_ITERATIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(username, hashName string) (ScramVerifier, error) {
+		if username != "user" {
+			return ScramVerifier{}, ErrUnknownUser
+		}
+
+		return verifier, nil
+	}
+
+	cb := &ChannelBinding{Type: "tls-unique", Data: []byte("finished message")}
+
+	tests := []struct {
+		name        string
+		mechanism   string
+		cb          *ChannelBinding
+		clientFirst string
+		err         error
+	}{
+		{"missing nonce", MECHANISM_SCRAM_SHA_256, nil, "n,,n=user", ErrInvalidResponse},
+		{"empty nonce", MECHANISM_SCRAM_SHA_256, nil, "n,,n=user,r=", ErrInvalidResponse},
+		{"bad flag", MECHANISM_SCRAM_SHA_256, nil, "x,,n=user,r=abc", ErrInvalidResponse},
+		{"bad escape", MECHANISM_SCRAM_SHA_256, nil, "n,,n=us=er,r=abc", ErrInvalidResponse},
+		{"other identity", MECHANISM_SCRAM_SHA_256, nil, "n,a=admin,n=user,r=abc", ErrInvalidCredentials},
+		{"downgrade", MECHANISM_SCRAM_SHA_256, cb, "y,,n=user,r=abc", ErrInvalidCredentials},
+		{"plus without binding", MECHANISM_SCRAM_SHA_256_PLUS, cb, "n,,n=user,r=abc", ErrInvalidResponse},
+		{"plus with other binding", MECHANISM_SCRAM_SHA_256_PLUS, cb, "p=tls-exporter,,n=user,r=abc", ErrInvalidResponse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := NewScramServer(tt.mechanism, lookup, tt.cb)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, done, err := server.Next([]byte(tt.clientFirst))
+			if !done || !errors.Is(err, tt.err) {
+				t.Errorf("Next() = %v, %v, want true, %v", done, err, tt.err)
+			}
+		})
+	}
+}
+
+// an unknown user gets the same salt every time and fails like a wrong
+// password
+func TestScramServerUnknownUser(t *testing.T) {
+	lookup := func(username, hashName string) (ScramVerifier, error) {
+		return ScramVerifier{}, ErrUnknownUser
+	}
+
+	var salts []string
+	for i := 0; i < 2; i++ {
+		server, err := NewScramServer(MECHANISM_SCRAM_SHA_256, lookup, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := NewScramClient(MECHANISM_SCRAM_SHA_256, "nobody", "pencil", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, response, _ := client.Start()
+
+		challenge, done, err := server.Next(response)
+		if err != nil || done {
+			t.Fatalf("client-first: %v, %v", done, err)
+		}
+
+		attrs := strings.Split(string(challenge), ",")
+		if len(attrs) != 3 || attrs[2] != "i=4096" {
+			t.Fatalf("server-first = %q", challenge)
+		}
+
+		salts = append(salts, attrs[1])
+
+		response, err = client.Next(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := server.Next(response); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("client-final error = %v, want %v", err, ErrInvalidCredentials)
+		}
+	}
+
+	if salts[0] != salts[1] {
+		t.Errorf("salts differ: %q and %q", salts[0], salts[1])
+	}
+}
+
+func TestScramVerifierString(t *testing.T) {
+	for _, v := range scramVectors {
+		t.Run(v.mechanism, func(t *testing.T) {
+			salt, _ := base64.StdEncoding.DecodeString(v.salt)
+
+			verifier, err := newScramVerifier(v.hashName, "pencil", salt, 4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, err := ParseScramVerifier(verifier.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if parsed.Hash != v.hashName || parsed.Iterations != 4096 || !bytes.Equal(parsed.Salt, salt) ||
+				!bytes.Equal(parsed.StoredKey, verifier.StoredKey) || !bytes.Equal(parsed.ServerKey, verifier.ServerKey) {
+				t.Errorf("ParseScramVerifier(%q) = %+v", verifier.String(), parsed)
+			}
+
+			if !parsed.CheckPassword("pencil") || parsed.CheckPassword("pen") {
+				t.Error("CheckPassword of the parsed verifier")
+			}
+		})
+	}
+}
+
+func TestParseScramVerifierErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"SCRAM-SHA-256",
+		"SCRAM-MD5$4096:QSXCR+Q6sek8bf92$a:b",
+		"SCRAM-SHA-256$0:QSXCR+Q6sek8bf92$a:b",
+		"SCRAM-SHA-256$4096:QSXCR+Q6sek8bf92$AAAA:AAAA",
+	}
+
+	for _, s := range tests {
+		if _, err := ParseScramVerifier(s); err == nil {
+			t.Errorf("ParseScramVerifier(%q) succeeded", s)
+		}
+	}
+}
+
+func TestScramName(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"user", "user"},
+		{"a,b", "a=2Cb"},
+		{"a=b", "a=3Db"},
+		{"=,", "=3D=2C"},
+	}
+
+	for _, tt := range tests {
+		if got := encodeScramName(tt.name); got != tt.encoded {
+			t.Errorf("encodeScramName(%q) = %q, want %q", tt.name, got, tt.encoded)
+		}
+
+		if got, err := decodeScramName(tt.encoded); err != nil || got != tt.name {
+			t.Errorf("decodeScramName(%q) = %q, %v, want %q", tt.encoded, got, err, tt.name)
+		}
+	}
+}
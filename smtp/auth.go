@@ -1,5 +1,11 @@
 package server
 
+import (
+	"log/slog"
+
+	"github.com/radenrishwan/sasl"
+)
+
 type SMTPAuth struct {
 	Username string
 	Password string
@@ -11,3 +17,33 @@ func NewSMTPAuth(username, password string) SMTPAuth {
 		Password: password,
 	}
 }
+
+// the SASL mechanisms offered on a connection, the -PLUS mechanisms need
+// the channel binding of TLS
+func (c *Conn) mechanisms() []string {
+	return sasl.Mechanisms(c.saslOptions())
+}
+
+func (c *Conn) saslOptions() sasl.ServerOptions {
+	return sasl.ServerOptions{
+		Hostname:       c.server.Hostname,
+		ChannelBinding: c.channelBinding(),
+		TokenVerifier:  c.server.TokenVerifier,
+	}
+}
+
+func (c *Conn) channelBinding() *sasl.ChannelBinding {
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		return nil
+	}
+
+	cb, err := sasl.TLSChannelBinding(state)
+	if err != nil {
+		slog.Error("Error getting channel binding", "ERROR", err.Error())
+
+		return nil
+	}
+
+	return cb
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/radenrishwan/sasl"
+)
+
+// the output of fn on stdout, where the sessions are logged
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	output := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		output <- string(b)
+	}()
+
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	fn()
+	w.Close()
+
+	return <-output
+}
+
+func TestCommandLogLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"MAIL FROM:<a@example.org>\r\n", "MAIL FROM:<a@example.org>"},
+		{"AUTH LOGIN\r\n", "AUTH LOGIN"},
+		{"AUTH PLAIN AGFsaWNlAHNlY3JldA==\r\n", "AUTH PLAIN " + LOG_REDACTED},
+		{"auth plain AGFsaWNlAHNlY3JldA==\r\n", "AUTH plain " + LOG_REDACTED},
+	}
+
+	for _, tt := range tests {
+		command := Command{}
+		command.Parse(tt.line)
+
+		if got := command.logLine(tt.line); got != tt.want {
+			t.Errorf("logLine(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+// the responses of an AUTH exchange hold the credentials and are not logged
+func TestAuthNotLogged(t *testing.T) {
+	const password = "s3cret-password"
+
+	b64 := base64.StdEncoding.EncodeToString
+	secrets := []string{b64([]byte(password)), b64([]byte("\x00alice\x00" + password))}
+
+	s := NewServer(":0", true, &testBackend{})
+	s.Credentials.(*sasl.MemoryStore).AddPassword("alice", password)
+
+	scripts := []struct {
+		script string
+		want   []int
+	}{
+		{"EHLO x\r\nAUTH PLAIN " + secrets[1] + "\r\nQUIT\r\n", []int{250, 235, 221}},
+		{"EHLO x\r\nAUTH PLAIN\r\n" + secrets[1] + "\r\nQUIT\r\n", []int{250, 334, 235, 221}},
+		{"EHLO x\r\nAUTH LOGIN\r\n" + b64([]byte("alice")) + "\r\n" + secrets[0] + "\r\nQUIT\r\n", []int{250, 334, 334, 235, 221}},
+	}
+
+	for _, script := range scripts {
+		var codes []int
+		output := captureStdout(t, func() {
+			codes = runScript(t, s, script.script)
+		})
+
+		if !reflect.DeepEqual(codes, script.want) {
+			t.Fatalf("replies = %v, want %v", codes, script.want)
+		}
+
+		for _, secret := range secrets {
+			if strings.Contains(output, secret) {
+				t.Errorf("server log contains %q:\n%s", secret, output)
+			}
+		}
+	}
+
+	// the client doesn't log them either
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Serve(listener)
+	defer listener.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	mail := NewMail()
+	mail.SetFrom("alice@example.org")
+	mail.AddTo("bob@example.org")
+	mail.Parse("Subject: hello\r\n\r\nbody\r\n")
+
+	for _, auth := range []Auth{PlainAuth{Username: "alice", Password: password}, SASLAuth{Username: "alice", Password: password, Mechanism: sasl.MECHANISM_LOGIN}} {
+		output := captureStdout(t, func() {
+			if err := NewDialer("127.0.0.1", port).SendMail(mail, auth); err != nil {
+				t.Errorf("SendMail() with %T: %v", auth, err)
+			}
+		})
+
+		for _, secret := range secrets {
+			if strings.Contains(output, secret) {
+				t.Errorf("log with %T contains %q:\n%s", auth, secret, output)
+			}
+		}
+	}
+}
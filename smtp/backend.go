@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+// Backend is used by the server to handle incoming mail. NewSession is called
+// once for every accepted connection.
+type Backend interface {
+	NewSession(c *Conn) (Session, error)
+}
+
+// Session receives the commands of a single connection. Every method can
+// return an *SMTPError to control the reply sent back to the client, any
+// other error is reported as a local error.
+type Session interface {
+	// called on MAIL FROM, from is empty for the null reverse-path <>
+	Mail(from string, opts *MailOptions) error
+	// called on every RCPT TO
+	Rcpt(to string, opts *RcptOptions) error
+	// called on DATA, r streams the message from the client with the dot
+	// stuffing removed and ends before the terminating dot
+	Data(r io.Reader) error
+	// called on RSET and after every finished transaction
+	Reset()
+	// called when the connection is closed
+	Logout() error
+}
+
+// state of the SMTP session
+type sessionState int
+
+const (
+	// connected, waiting for HELO or EHLO
+	stateInit sessionState = iota
+	// HELO or EHLO accepted, no mail transaction
+	stateGreeted
+	// MAIL accepted, waiting for RCPT
+	stateMail
+	// at least one RCPT accepted, DATA is allowed
+	stateRcpt
+	// BDAT without LAST accepted, only BDAT is allowed
+	stateChunking
+)
+
+// Conn is the connection of a client to the server.
+type Conn struct {
+	conn    net.Conn
+	server  *Server
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	session Session
+	mail    Mail
+	// parameters of the MAIL command of the current transaction
+	mailOptions *MailOptions
+	chunking    *chunking
+
+	state    sessionState
+	authUser string
+	closed   bool
+}
+
+func (c *Conn) Server() *Server {
+	return c.server
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// AuthUser returns the authenticated user, empty if the client is not
+// authenticated.
+func (c *Conn) AuthUser() string {
+	return c.authUser
+}
+
+func (c *Conn) Session() Session {
+	return c.session
+}
+
+// Mail returns the envelope of the current transaction: the sender, the
+// accepted recipients and the parameters of MAIL and RCPT. The message
+// itself is passed to Session.Data.
+func (c *Conn) Mail() Mail {
+	return c.mail
+}
+
+// Reply sends a reply to the client, to be used by a CommandHandler. An
+// empty enhancedCode is replaced by class.0.0 of the code.
+func (c *Conn) Reply(code int, enhancedCode EnhancedCode, message string) {
+	replyError(c.writer, NewSMTPError(code, enhancedCode, message))
+}
+
+// Close closes the connection once the current command is handled.
+func (c *Conn) Close() {
+	c.closed = true
+}
+
+// TLSConnectionState returns the state of the TLS connection, ok is false
+// when the connection is not encrypted.
+func (c *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+
+	return tlsConn.ConnectionState(), true
+}
+
+func (c *Conn) isTLS() bool {
+	_, ok := c.conn.(*tls.Conn)
+
+	return ok
+}
+
+// reset the current mail transaction
+func (c *Conn) reset() {
+	c.mail = NewMail()
+	c.mailOptions = nil
+	c.endChunking(errChunkingAborted)
+
+	if c.state > stateGreeted {
+		c.state = stateGreeted
+	}
+
+	if c.session != nil {
+		c.session.Reset()
+	}
+}
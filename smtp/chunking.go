@@ -0,0 +1,161 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+var errChunkingAborted = errors.New("BDAT transaction aborted")
+
+// chunking is a BDAT transaction in progress, RFC 3030. The chunks are
+// written to a pipe read by Session.Data running in its own goroutine.
+type chunking struct {
+	writer *io.PipeWriter
+	// result of Session.Data
+	done chan error
+
+	size     int64
+	tooLarge bool
+}
+
+func (c *Conn) startChunking() {
+	pr, pw := io.Pipe()
+
+	ch := &chunking{
+		writer: pw,
+		done:   make(chan error, 1),
+	}
+
+	go func() {
+		err := c.session.Data(pr)
+		// the rest of the chunks are discarded when the session returns early
+		pr.Close()
+		ch.done <- err
+	}()
+
+	c.chunking = ch
+}
+
+// end the BDAT transaction, err is nil after BDAT LAST. Returns the result
+// of Session.Data.
+func (c *Conn) endChunking(err error) error {
+	ch := c.chunking
+	if ch == nil {
+		return nil
+	}
+
+	c.chunking = nil
+
+	if err != nil {
+		ch.writer.CloseWithError(err)
+	} else {
+		ch.writer.Close()
+	}
+
+	return <-ch.done
+}
+
+// Write passes a chunk to the session, the data is dropped once the session
+// stopped reading or the message is too large.
+func (ch *chunking) Write(p []byte) (int, error) {
+	if ch.tooLarge {
+		return len(p), nil
+	}
+
+	ch.writer.Write(p)
+
+	return len(p), nil
+}
+
+func handleBdat(c *Conn, command Command) {
+	if len(command.Args) == 0 || len(command.Args) > 2 {
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_ARGUMENTS, "Syntax: BDAT <size> [LAST]")
+
+		return
+	}
+
+	size, err := strconv.ParseInt(command.Args[0], 10, 64)
+	if err != nil || size < 0 {
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_ARGUMENTS, "Invalid chunk size")
+
+		return
+	}
+
+	last := false
+	if len(command.Args) == 2 {
+		if !strings.EqualFold(command.Args[1], "LAST") {
+			reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_ARGUMENTS, "Syntax: BDAT <size> [LAST]")
+
+			return
+		}
+
+		last = true
+	}
+
+	// the chunk is always read, even when the command is refused
+	if c.state != stateRcpt && c.state != stateChunking {
+		if _, err := io.CopyN(io.Discard, c.reader, size); err != nil {
+			slog.Error("Error reading from connection", "ERROR", err.Error())
+			c.Close()
+
+			return
+		}
+
+		reply(c.writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "Need RCPT command first")
+
+		return
+	}
+
+	if c.chunking == nil {
+		c.startChunking()
+		c.state = stateChunking
+	}
+
+	ch := c.chunking
+	max := c.server.MaxMessageBytes
+
+	ch.size += size
+	if max > 0 && ch.size > max && !ch.tooLarge {
+		ch.tooLarge = true
+		ch.writer.CloseWithError(errMessageTooLarge)
+	}
+
+	if _, err := io.CopyN(ch, c.reader, size); err != nil {
+		slog.Error("Error reading from connection", "ERROR", err.Error())
+		c.endChunking(err)
+		c.Close()
+
+		return
+	}
+
+	fmt.Println("Client:", size, "octets of BDAT data")
+
+	if ch.tooLarge {
+		c.endChunking(errMessageTooLarge)
+		c.reset()
+		replyError(c.writer, errMessageTooLarge)
+
+		return
+	}
+
+	if !last {
+		reply(c.writer, SMTP_STATUS_OK, SMTP_ENHANCED_OK, fmt.Sprintf("%d octets received", size))
+
+		return
+	}
+
+	err = c.endChunking(nil)
+	c.reset()
+
+	if err != nil {
+		replyError(c.writer, err)
+
+		return
+	}
+
+	reply(c.writer, SMTP_STATUS_OK, SMTP_ENHANCED_MESSAGE_OK, fmt.Sprintf("Message accepted, %d octets received", ch.size))
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBdat(t *testing.T) {
+	const envelope = "EHLO x\r\nMAIL FROM:<a@example.org>\r\nRCPT TO:<b@example.org>\r\n"
+
+	tests := []struct {
+		name   string
+		max    int64
+		script string
+		want   []int
+		// the messages passed to the session
+		messages []string
+	}{
+		{
+			name:     "chunks",
+			script:   envelope + "BDAT 5\r\nhelloBDAT 8 LAST\r\n world\r\n",
+			want:     []int{250, 250, 250, 250, 250},
+			messages: []string{"hello world\r\n"},
+		},
+		{
+			name:     "no dot-unstuffing",
+			script:   envelope + "BDAT 13 LAST\r\n..x\r\n.\r\nend\r\n",
+			want:     []int{250, 250, 250, 250},
+			messages: []string{"..x\r\n.\r\nend\r\n"},
+		},
+		{
+			name:     "empty last chunk",
+			script:   envelope + "BDAT 4\r\nbodyBDAT 0 LAST\r\n",
+			want:     []int{250, 250, 250, 250, 250},
+			messages: []string{"body"},
+		},
+		{
+			name:     "binarymime",
+			script:   "EHLO x\r\nMAIL FROM:<a@example.org> BODY=BINARYMIME\r\nRCPT TO:<b@example.org>\r\nBDAT 3 LAST\r\n\x00\xff\n",
+			want:     []int{250, 250, 250, 250},
+			messages: []string{"\x00\xff\n"},
+		},
+		{
+			name:   "binarymime with data",
+			script: "EHLO x\r\nMAIL FROM:<a@example.org> BODY=BINARYMIME\r\nRCPT TO:<b@example.org>\r\nDATA\r\n",
+			want:   []int{250, 250, 250, 503},
+		},
+		{
+			name:   "before rcpt",
+			script: "EHLO x\r\nMAIL FROM:<a@example.org>\r\nBDAT 4 LAST\r\nRSETNOOP\r\n",
+			want:   []int{250, 250, 503, 250},
+		},
+		{
+			name:     "data during bdat",
+			script:   envelope + "BDAT 3\r\nabcDATA\r\nBDAT 3 LAST\r\ndef",
+			want:     []int{250, 250, 250, 250, 503, 250},
+			messages: []string{"abcdef"},
+		},
+		{
+			name:     "rset aborts",
+			script:   envelope + "BDAT 3\r\nabcRSET\r\nBDAT 3 LAST\r\ndef",
+			want:     []int{250, 250, 250, 250, 250, 503},
+			messages: nil,
+		},
+		{
+			name:   "too large",
+			max:    10,
+			script: envelope + "BDAT 6\r\n123456BDAT 6 LAST\r\n789012NOOP\r\n",
+			want:   []int{250, 250, 250, 250, 552, 250},
+		},
+		{
+			name:   "invalid size",
+			script: envelope + "BDAT x\r\nBDAT 1 FIRST\r\n",
+			want:   []int{250, 250, 250, 501, 501},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &testBackend{}
+			s := NewServer(":0", false, backend)
+			s.MaxMessageBytes = tt.max
+
+			codes := runScript(t, s, tt.script+"QUIT\r\n")
+
+			want := append(tt.want, SMTP_STATUS_BYE)
+			if !reflect.DeepEqual(codes, want) {
+				t.Errorf("replies = %v, want %v", codes, want)
+			}
+
+			var messages []string
+			for _, m := range backend.messages {
+				messages = append(messages, m.data)
+			}
+
+			if !reflect.DeepEqual(messages, tt.messages) {
+				t.Errorf("messages = %q, want %q", messages, tt.messages)
+			}
+		})
+	}
+}
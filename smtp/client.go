@@ -2,11 +2,34 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/radenrishwan/sasl"
+)
+
+var (
+	// the mail needs SMTPUTF8 and the server doesn't support it, the
+	// addresses can't be downgraded (RFC 6531 section 3.2)
+	ErrSMTPUTF8NotSupported = errors.New("server does not support SMTPUTF8")
+	// the mail has an 8 bit body and the server doesn't support 8BITMIME
+	Err8BitMIMENotSupported = errors.New("server does not support 8BITMIME")
+)
+
+// timeouts of the Dialer, RFC 5321 section 4.5.3.2 asks for at least 5
+// minutes for a reply and 10 minutes for the reply to the terminating dot
+const (
+	DIAL_TIMEOUT    = 30 * time.Second
+	COMMAND_TIMEOUT = 5 * time.Minute
+	DATA_TIMEOUT    = 10 * time.Minute
 )
 
 type Auth interface {
@@ -18,11 +41,51 @@ type PlainAuth struct {
 	Password string
 }
 
+func (a PlainAuth) Validate() bool {
+	return a.Username != "" && a.Password != ""
+}
+
+// SASLAuth authenticates with the strongest SASL mechanism offered by the
+// server, or with Mechanism when it is set. With a Token OAUTHBEARER or
+// XOAUTH2 is used instead of the password.
+type SASLAuth struct {
+	Username  string
+	Password  string
+	Token     string
+	Mechanism string
+}
+
+func (a SASLAuth) Validate() bool {
+	return a.Username != "" && (a.Password != "" || a.Token != "")
+}
+
+// mechanisms tried by SASLAuth, strongest first
+var clientMechanisms = []string{
+	sasl.MECHANISM_SCRAM_SHA_256_PLUS,
+	sasl.MECHANISM_SCRAM_SHA_1_PLUS,
+	sasl.MECHANISM_SCRAM_SHA_256,
+	sasl.MECHANISM_SCRAM_SHA_1,
+	sasl.MECHANISM_CRAM_MD5,
+	sasl.MECHANISM_PLAIN,
+	sasl.MECHANISM_LOGIN,
+}
+
 type Dialer struct {
-	Host   string
-	Port   string
-	reader *bufio.Reader
-	writer *bufio.Writer
+	Host string
+	Port string
+	// upgrades the connection with STARTTLS when set and the server
+	// supports it
+	TLSConfig *tls.Config
+	// limits connecting to the server, DIAL_TIMEOUT when 0
+	Timeout time.Duration
+	// limits sending a command and reading its reply, COMMAND_TIMEOUT and
+	// DATA_TIMEOUT when 0
+	CommandTimeout time.Duration
+	conn           net.Conn
+	reader         *bufio.Reader
+	writer         *bufio.Writer
+	// extensions advertised in the EHLO reply, e.g. "PIPELINING" -> ""
+	extensions map[string]string
 }
 
 func NewDialer(host, port string) *Dialer {
@@ -33,8 +96,14 @@ func NewDialer(host, port string) *Dialer {
 }
 
 func (d *Dialer) Dial() (net.Conn, error) {
-	addr := d.Host + ":" + d.Port
-	conn, err := net.Dial("tcp", addr)
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DIAL_TIMEOUT
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(d.Host, d.Port))
 	if err != nil {
 		return nil, err
 	}
@@ -48,83 +117,520 @@ func (d *Dialer) Close(conn net.Conn) {
 
 // use nil if the server does not require authentication
 func (d *Dialer) SendMail(mail Mail, auth Auth) error {
+	if len(mail.To) == 0 {
+		return errors.New("mail has no recipients")
+	}
+
 	conn, err := d.Dial()
 	if err != nil {
 		return err
 	}
 
-	defer d.Close(conn)
+	d.setConn(conn)
+
+	// the connection is replaced by STARTTLS
+	defer func() {
+		d.Close(d.conn)
+	}()
+
+	// waiting for server to send 220
+	if _, err := d.expect(SMTP_STATUS_READY); err != nil {
+		return err
+	}
+
+	if err := d.hello(); err != nil {
+		return err
+	}
+
+	if _, ok := d.extensions[SMTP_COMMAND_STARTTLS]; ok && d.TLSConfig != nil {
+		if err := d.startTLS(); err != nil {
+			return err
+		}
+	}
+
+	// refuse to downgrade the mail when the server lacks an extension
+	if err := d.checkExtensions(mail); err != nil {
+		d.reply(SMTP_COMMAND_QUIT)
+
+		return err
+	}
+
+	if auth != nil {
+		if err := d.auth(auth); err != nil {
+			return err
+		}
+	}
+
+	refused, err := d.envelope(mail)
+	if err != nil {
+		return err
+	}
+
+	// with PIPELINING DATA was sent with the envelope
+	if _, ok := d.extensions["PIPELINING"]; !ok {
+		d.reply(SMTP_COMMAND_DATA)
+
+		if _, err := d.expect(SMTP_STATUS_SEND_DATA); err != nil {
+			return err
+		}
+	}
+
+	d.writeMessage(mail)
+
+	if _, err := d.expectWithin(SMTP_STATUS_OK, DATA_TIMEOUT); err != nil {
+		return err
+	}
+
+	d.reply(SMTP_COMMAND_QUIT)
+	d.expect(SMTP_STATUS_BYE)
+
+	if len(refused) > 0 {
+		return &RcptError{Errors: refused}
+	}
 
+	return nil
+}
+
+// RcptError is returned by SendMail when the server refused recipients. The
+// mail was delivered to the other recipients, or to nobody when all of them
+// were refused.
+type RcptError struct {
+	// the reply to RCPT of every refused recipient, usually an *SMTPError
+	Errors map[string]error
+}
+
+func (e *RcptError) Error() string {
+	recipients := make([]string, 0, len(e.Errors))
+	for recipient, err := range e.Errors {
+		recipients = append(recipients, recipient+": "+err.Error())
+	}
+
+	sort.Strings(recipients)
+
+	return "recipients refused: " + strings.Join(recipients, ", ")
+}
+
+// send EHLO and fall back to HELO for servers without ESMTP
+func (d *Dialer) hello() error {
+	d.reply(SMTP_COMMAND_EHLO, d.Host)
+
+	lines, err := d.expect(SMTP_STATUS_OK)
+
+	// only a refused EHLO is tried again with HELO
+	var smtpErr *SMTPError
+	if err != nil && !errors.As(err, &smtpErr) {
+		return err
+	}
+
+	if err != nil {
+		d.reply(SMTP_COMMAND_HELO, d.Host)
+
+		_, err = d.expect(SMTP_STATUS_OK)
+
+		return err
+	}
+
+	d.extensions = make(map[string]string)
+
+	// the first line is the greeting
+	for _, line := range lines[1:] {
+		keyword, param, _ := strings.Cut(line, " ")
+		d.extensions[strings.ToUpper(keyword)] = param
+	}
+
+	return nil
+}
+
+func (d *Dialer) checkExtensions(mail Mail) error {
+	if _, ok := d.extensions["SMTPUTF8"]; mail.UTF8 && !ok {
+		return ErrSMTPUTF8NotSupported
+	}
+
+	switch mail.BodyType {
+	case "8BITMIME":
+		if _, ok := d.extensions["8BITMIME"]; !ok {
+			return Err8BitMIMENotSupported
+		}
+	case "BINARYMIME":
+		return errors.New("BINARYMIME can't be sent with DATA")
+	}
+
+	return nil
+}
+
+func (d *Dialer) setConn(conn net.Conn) {
+	d.conn = conn
 	d.reader = bufio.NewReader(conn)
 	d.writer = bufio.NewWriter(conn)
+}
 
-	// waiting for server to send 220
-	line, err := d.reader.ReadString('\n')
+// upgrade the connection to TLS, the extensions are asked again with EHLO
+// as the server may offer others over TLS (RFC 3207)
+func (d *Dialer) startTLS() error {
+	d.reply(SMTP_COMMAND_STARTTLS)
+
+	if _, err := d.expect(SMTP_STATUS_READY); err != nil {
+		return err
+	}
+
+	config := d.TLSConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = d.Host
+	}
+
+	tlsConn := tls.Client(d.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	d.setConn(tlsConn)
+
+	return d.hello()
+}
+
+func (d *Dialer) auth(auth Auth) error {
+	var a SASLAuth
+
+	switch auth := auth.(type) {
+	case PlainAuth:
+		a = SASLAuth{Username: auth.Username, Password: auth.Password, Mechanism: sasl.MECHANISM_PLAIN}
+	case *PlainAuth:
+		a = SASLAuth{Username: auth.Username, Password: auth.Password, Mechanism: sasl.MECHANISM_PLAIN}
+	case SASLAuth:
+		a = auth
+	case *SASLAuth:
+		a = *auth
+	default:
+		return errors.New("unsupported authentication")
+	}
+
+	if !a.Validate() {
+		return errors.New("unsupported authentication")
+	}
+
+	offered := strings.Fields(strings.ToUpper(d.extensions["AUTH"]))
+
+	mechanisms, secret := clientMechanisms, a.Password
+	if a.Token != "" {
+		mechanisms, secret = []string{sasl.MECHANISM_OAUTHBEARER, sasl.MECHANISM_XOAUTH2}, a.Token
+	}
+
+	mechanism := strings.ToUpper(a.Mechanism)
+	if mechanism == "" {
+		for _, m := range mechanisms {
+			if slices.Contains(offered, m) && (!strings.HasSuffix(m, "-PLUS") || d.channelBinding() != nil) {
+				mechanism = m
+
+				break
+			}
+		}
+	}
+
+	if mechanism == "" || !slices.Contains(offered, mechanism) {
+		return errors.New("server does not support the authentication mechanism")
+	}
+
+	// SCRAM without -PLUS tells the server that channel binding is supported
+	// by the client, which is only true when the server didn't offer it
+	cb := d.channelBinding()
+	if slices.Contains(offered, mechanism+"-PLUS") {
+		cb = nil
+	}
+
+	client, err := sasl.NewClient(mechanism, a.Username, secret, cb)
 	if err != nil {
 		return err
 	}
 
-	// if the response is not 220, return error
-	if !strings.HasPrefix(line, strconv.Itoa(SMTP_STATUS_READY)) {
-		return errors.New("server did not respond with 220")
+	return d.authenticate(client)
+}
+
+// run the exchange of a SASL client, the initial response is sent with AUTH
+func (d *Dialer) authenticate(client sasl.Client) error {
+	mechanism, response, err := client.Start()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case response == nil:
+		d.reply(SMTP_COMMAND_AUTH, mechanism)
+	case len(response) == 0:
+		d.reply(SMTP_COMMAND_AUTH, mechanism, "=")
+	default:
+		d.replySecret(SMTP_COMMAND_AUTH+" "+mechanism+" ", base64.StdEncoding.EncodeToString(response))
 	}
 
 	for {
-		// waiting for server to send 220
-		line, err := d.reader.ReadString('\n')
-		if err != nil {
+		lines, err := d.expect(SMTP_STATUS_AUTH_SUCCESS)
+		if err == nil {
+			return nil
+		}
+
+		var smtpErr *SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != SMTP_STATUS_AUTH_CONTINUE {
 			return err
 		}
 
-		// if the response is not 220, return error
-		if !strings.HasPrefix(line, strconv.Itoa(SMTP_STATUS_READY)) {
-			return errors.New("server did not respond with 220")
+		// the challenge may be left out when it is empty
+		encoded := ""
+		if len(lines) > 0 {
+			encoded = lines[0]
 		}
 
-		// send ehlo
-		d.reply(SMTP_COMMAND_EHLO, []string{d.Host})
+		challenge, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			response, err = client.Next(challenge)
+		}
 
-		// waiting for server to send 250
-		line, err = d.reader.ReadString('\n')
 		if err != nil {
+			// cancel the exchange
+			d.reply("*")
+			d.expect(SMTP_STATUS_ERROR_SYNTAX)
+
 			return err
 		}
 
-		// if the response is not 250, return error
-		if !strings.HasPrefix(line, strconv.Itoa(SMTP_STATUS_OK)) {
-			return errors.New("server did not respond with 250")
+		d.replySecret("", base64.StdEncoding.EncodeToString(response))
+	}
+}
+
+// the channel binding of the connection, nil without TLS
+func (d *Dialer) channelBinding() *sasl.ChannelBinding {
+	tlsConn, ok := d.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	cb, err := sasl.TLSChannelBinding(tlsConn.ConnectionState())
+	if err != nil {
+		return nil
+	}
+
+	return cb
+}
+
+// send MAIL FROM and RCPT TO, the commands are sent at once and the replies
+// read afterwards when the server supports PIPELINING (RFC 2920). The refused
+// recipients are returned, an error is only returned when the transaction
+// can't go on: MAIL was refused or no recipient was accepted.
+func (d *Dialer) envelope(mail Mail) (map[string]error, error) {
+	_, pipelining := d.extensions["PIPELINING"]
+
+	_, dsn := d.extensions["DSN"]
+
+	from := SMTP_COMMAND_MAIL + " FROM:<" + mail.From + ">"
+	if mail.BodyType == "8BITMIME" {
+		from += " BODY=8BITMIME"
+	}
+
+	if mail.UTF8 {
+		from += " SMTPUTF8"
+	}
+
+	// the DSN parameters are passed on when the server supports them
+	if dsn && mail.Return != "" {
+		from += " RET=" + mail.Return
+	}
+
+	if dsn && mail.EnvelopeID != "" {
+		from += " ENVID=" + encodeXtext(mail.EnvelopeID)
+	}
+
+	rcpts := make([]string, len(mail.To))
+	for i, to := range mail.To {
+		rcpt := SMTP_COMMAND_RCPT + " TO:<" + to + ">"
+
+		if opts := mail.Recipients[to]; dsn && opts != nil {
+			if len(opts.Notify) > 0 {
+				rcpt += " NOTIFY=" + strings.Join(opts.Notify, ",")
+			}
+
+			if opts.OriginalRecipient != "" {
+				rcpt += " ORCPT=" + opts.OriginalRecipientType + ";" + encodeXtext(opts.OriginalRecipient)
+			}
+		}
+
+		rcpts[i] = rcpt
+	}
+
+	refused := make(map[string]error)
+
+	if !pipelining {
+		d.reply(from)
+
+		if _, err := d.expect(SMTP_STATUS_OK); err != nil {
+			return nil, err
+		}
+
+		for i, rcpt := range rcpts {
+			d.reply(rcpt)
+
+			if _, err := d.expect(SMTP_STATUS_OK); err != nil {
+				refused[mail.To[i]] = err
+			}
+		}
+
+		if len(refused) == len(rcpts) {
+			d.reply(SMTP_COMMAND_QUIT)
+
+			return nil, &RcptError{Errors: refused}
 		}
 
-		// check if server needs authentication
+		return refused, nil
+	}
 
-		// send mail from
+	d.write(from)
+	for _, rcpt := range rcpts {
+		d.write(rcpt)
+	}
 
-		// send rcpt to
+	// DATA is the last command of the group
+	d.write(SMTP_COMMAND_DATA)
+	d.flush()
 
-		// send data
+	// every reply has to be read to stay in sync with the server
+	_, mailErr := d.expect(SMTP_STATUS_OK)
 
-		// send mail body
+	for i := range rcpts {
+		if _, err := d.expect(SMTP_STATUS_OK); err != nil {
+			refused[mail.To[i]] = err
+		}
+	}
 
-		// send .
+	// when DATA is accepted although the transaction failed, closing the
+	// connection without the terminating dot aborts it
+	_, dataErr := d.expect(SMTP_STATUS_SEND_DATA)
 
-		// send quit
+	switch {
+	case mailErr != nil:
+		return nil, mailErr
+	case len(refused) == len(rcpts):
+		return nil, &RcptError{Errors: refused}
+	case dataErr != nil:
+		return nil, dataErr
 	}
+
+	return refused, nil
 }
 
-func (d *Dialer) reply(command string, args []string) {
-	response := command + " " + strings.Join(args, " ")
+// write the headers and body of the mail followed by the terminating dot,
+// lines starting with a dot are dot-stuffed
+func (d *Dialer) writeMessage(mail Mail) {
+	message := strings.TrimSuffix(mail.message(), "\r\n")
+	for _, line := range strings.Split(message, "\r\n") {
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
 
-	d.writer.WriteString(response)
-	d.writer.Flush()
+		// the deadline limits the time without progress, not the whole
+		// message
+		if d.writer.Available() < len(line)+2 {
+			d.setDeadline(COMMAND_TIMEOUT)
+		}
 
-	fmt.Println("Client: ", response)
+		d.writer.WriteString(line + "\r\n")
+	}
+
+	d.writer.WriteString(".\r\n")
+	d.flush()
 }
 
-func (d *Dialer) replyAuth(username, password string) {
-	response := username + "\x00" + username + "\x00" + password
+// read a reply and check its code, the lines are returned without code
+func (d *Dialer) expect(code int) ([]string, error) {
+	return d.expectWithin(code, COMMAND_TIMEOUT)
+}
 
-	d.writer.WriteString(response)
+// expect with the time the server has for the reply
+func (d *Dialer) expectWithin(code int, timeout time.Duration) ([]string, error) {
+	d.setDeadline(timeout)
+
+	var lines []string
+
+	for {
+		line, err := d.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		fmt.Println("Server: ", line)
+
+		if len(line) < 3 || len(line) > 3 && line[3] != ' ' && line[3] != '-' {
+			return nil, errors.New("invalid reply: " + line)
+		}
+
+		if len(line) > 3 {
+			lines = append(lines, line[4:])
+
+			if line[3] == '-' {
+				continue
+			}
+		}
+
+		if line[:3] != strconv.Itoa(code) {
+			return lines, parseReplyError(line)
+		}
+
+		return lines, nil
+	}
+}
+
+// the error of an unexpected reply, e.g. "550 5.1.1 No such user"
+func parseReplyError(line string) error {
+	code, err := strconv.Atoi(line[:3])
+	if err != nil {
+		return errors.New("invalid reply: " + line)
+	}
+
+	message := strings.TrimSpace(line[3:])
+
+	// the enhanced code has the same class as the reply code
+	var enhanced EnhancedCode
+	if first, rest, ok := strings.Cut(message, " "); ok && strings.Count(first, ".") == 2 && first[0] == line[0] {
+		enhanced, message = EnhancedCode(first), rest
+	}
+
+	return NewSMTPError(code, enhanced, message)
+}
+
+// send a command right away
+func (d *Dialer) reply(command string, args ...string) {
+	d.write(command, args...)
+	d.flush()
+}
+
+// send a line ending with credentials right away, they are left out of the
+// log
+func (d *Dialer) replySecret(prefix, secret string) {
+	d.writer.WriteString(prefix + secret + "\r\n")
+	d.flush()
+
+	fmt.Println("Client: ", prefix+LOG_REDACTED)
+}
+
+// send the buffered commands, the server has to take them within the
+// command timeout
+func (d *Dialer) flush() {
+	d.setDeadline(COMMAND_TIMEOUT)
 	d.writer.Flush()
+}
+
+// set the deadline of the connection, CommandTimeout replaces timeout when
+// set
+func (d *Dialer) setDeadline(timeout time.Duration) {
+	if d.CommandTimeout > 0 {
+		timeout = d.CommandTimeout
+	}
+
+	d.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+func (d *Dialer) write(command string, args ...string) {
+	response := strings.Join(append([]string{command}, args...), " ")
+
+	d.writer.WriteString(response + "\r\n")
 
 	fmt.Println("Client: ", response)
 }
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseReplyError(t *testing.T) {
+	tests := []struct {
+		line string
+		want *SMTPError
+	}{
+		{"550 5.1.1 No such user", NewSMTPError(550, "5.1.1", "No such user")},
+		{"451 Try again", NewSMTPError(451, "", "Try again")},
+		// the enhanced code has the class of the reply code
+		{"550 4.1.1 odd", NewSMTPError(550, "", "4.1.1 odd")},
+		{"554", NewSMTPError(554, "", "")},
+	}
+
+	for _, tt := range tests {
+		err := parseReplyError(tt.line)
+
+		var smtpErr *SMTPError
+		if !errors.As(err, &smtpErr) || !reflect.DeepEqual(smtpErr, tt.want) {
+			t.Errorf("parseReplyError(%q) = %#v, want %#v", tt.line, err, tt.want)
+		}
+	}
+}
+
+func TestDialerSendMail(t *testing.T) {
+	backend := &testBackend{}
+	s := NewServer(":0", false, backend)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Serve(listener)
+	defer listener.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	mail := NewMail()
+	mail.SetFrom("alice@example.org")
+	mail.AddTo("bob@example.org")
+	mail.AddTo("unknown@example.org")
+	mail.Parse("Received: from a\r\nReceived: from b\r\n\r\n.leading dot\r\n.\r\nend\r\n")
+
+	err = NewDialer("127.0.0.1", port).SendMail(mail, nil)
+
+	// the mail is delivered to the accepted recipient
+	var rcptErr *RcptError
+	if !errors.As(err, &rcptErr) || len(rcptErr.Errors) != 1 || rcptErr.Errors["unknown@example.org"] == nil {
+		t.Fatalf("SendMail() error = %v, want a RcptError for unknown@example.org", err)
+	}
+
+	if len(backend.messages) != 1 {
+		t.Fatalf("%d messages, want 1", len(backend.messages))
+	}
+
+	got := backend.messages[0]
+	if got.data != mail.Raw {
+		t.Errorf("data = %q, want %q", got.data, mail.Raw)
+	}
+
+	if !reflect.DeepEqual(got.mail.To, []string{"bob@example.org"}) {
+		t.Errorf("recipients = %q", got.mail.To)
+	}
+
+	// nothing is sent when every recipient is refused
+	mail.To = []string{"unknown@example.org"}
+
+	err = NewDialer("127.0.0.1", port).SendMail(mail, nil)
+	if !errors.As(err, &rcptErr) {
+		t.Fatalf("SendMail() error = %v, want a RcptError", err)
+	}
+
+	if len(backend.messages) != 1 {
+		t.Errorf("%d messages, want 1", len(backend.messages))
+	}
+}
+
+// a server that stops answering doesn't keep the client waiting
+func TestDialerTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		// the lines the server answers before it stops
+		replies []string
+	}{
+		{"no greeting", nil},
+		{"no reply to ehlo", []string{"220 ready"}},
+		{"no reply to data", []string{"220 ready", "250 hello", "250 ok", "250 ok", "354 go ahead"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer listener.Close()
+
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+
+				defer conn.Close()
+
+				// a reply to the greeting and every command
+				r := bufio.NewReader(conn)
+				for i, reply := range tt.replies {
+					if i > 0 {
+						r.ReadString('\n')
+					}
+
+					conn.Write([]byte(reply + "\r\n"))
+				}
+
+				// wait for the client to give up
+				io.Copy(io.Discard, r)
+			}()
+
+			_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+			mail := NewMail()
+			mail.SetFrom("alice@example.org")
+			mail.AddTo("bob@example.org")
+			mail.Parse("Subject: hello\r\n\r\nbody\r\n")
+
+			dialer := NewDialer("127.0.0.1", port)
+			dialer.CommandTimeout = 100 * time.Millisecond
+
+			start := time.Now()
+
+			err = dialer.SendMail(mail, nil)
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("SendMail() error = %v, want %v", err, os.ErrDeadlineExceeded)
+			}
+
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("SendMail() took %v", elapsed)
+			}
+		})
+	}
+}
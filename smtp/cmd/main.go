@@ -1,20 +1,128 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 
-	server "github.com/radenrishwan/smtp-from-scratch"
+	"github.com/radenrishwan/sasl"
+	server "github.com/radenrishwan/smtp"
 )
 
 var (
 	PORT = flag.String("port", "2525", "Port to run the SMTP server on. Default is 2525")
+	// DEFAULT PORT FOR SUBMISSION WITH IMPLICIT TLS is 465
+	TLS_PORT = flag.String("tls-port", "4650", "Port to run the implicit TLS server on when a certificate is given. Default is 4650")
+	CERT     = flag.String("cert", "", "TLS certificate file, enables STARTTLS and implicit TLS")
+	KEY      = flag.String("key", "", "TLS private key file")
+	MAX_SIZE = flag.Int64("max-size", 10<<20, "Maximum message size in bytes, 0 for no limit. Default is 10 MiB")
+	JWKS     = flag.String("jwks", "", "JWK Set file with the keys of the token issuer, enables OAUTHBEARER and XOAUTH2")
+	ISSUER   = flag.String("jwt-issuer", "", "Required issuer of the tokens")
+	AUDIENCE = flag.String("jwt-audience", "", "Required audience of the tokens")
+	FORWARD  = flag.Bool("forward", false, "Relay the received mail to the MX hosts of the recipients instead of printing it, requires authentication")
 )
 
+// printBackend prints every received mail to stdout
+type printBackend struct{}
+
+func (printBackend) NewSession(c *server.Conn) (server.Session, error) {
+	if state, ok := c.TLSConnectionState(); ok {
+		fmt.Println("TLS connection from", c.RemoteAddr(), "version", tls.VersionName(state.Version))
+	}
+
+	return &printSession{mail: server.NewMail()}, nil
+}
+
+type printSession struct {
+	mail server.Mail
+}
+
+func (s *printSession) Mail(from string, opts *server.MailOptions) error {
+	s.mail.SetFrom(from)
+
+	return nil
+}
+
+func (s *printSession) Rcpt(to string, opts *server.RcptOptions) error {
+	s.mail.AddTo(to)
+
+	return nil
+}
+
+func (s *printSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mail.Parse(string(data))
+
+	fmt.Println(s.mail)
+
+	return nil
+}
+
+func (s *printSession) Reset() {
+	s.mail = server.NewMail()
+}
+
+func (s *printSession) Logout() error {
+	return nil
+}
+
+// forwardBackend relays every received mail to the recipient domains
+type forwardBackend struct{}
+
+func (forwardBackend) NewSession(c *server.Conn) (server.Session, error) {
+	return server.NewForwardSession(c, server.NewForwarder(c.Server().Hostname)), nil
+}
+
 func main() {
 	flag.Parse()
 
-	s := server.NewServer(*PORT, true)
+	var backend server.Backend = printBackend{}
+	if *FORWARD {
+		backend = forwardBackend{}
+	}
+
+	s := server.NewServer(*PORT, true, backend)
+	s.MaxMessageBytes = *MAX_SIZE
+
+	// don't relay mail for anyone
+	s.RequireAuth = *FORWARD
+
+	if *JWKS != "" {
+		verifier, err := sasl.NewJWTVerifier(*JWKS, *ISSUER, *AUDIENCE)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.TokenVerifier = verifier
+	}
+
+	if *CERT != "" {
+		cert, err := tls.LoadX509KeyPair(*CERT, *KEY)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		s.RequireTLSForAuth = true
+
+		listener, err := net.Listen("tcp", ":"+*TLS_PORT)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := s.ServeTLS(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
 	if err := s.ListenAndServe(); err != nil {
 		log.Fatal(err)
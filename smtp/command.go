@@ -2,17 +2,39 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
+
+	"github.com/radenrishwan/sasl"
 )
 
 type Command struct {
 	Command string
 	Args    []string
+	// everything after the command, as sent by the client
+	RawArgs string
 }
 
+// replaces the credentials in the logged lines of an AUTH exchange
+const LOG_REDACTED = "[redacted]"
+
+// the line of a command as it is logged, the initial response of AUTH holds
+// the credentials and is left out
+func (c *Command) logLine(line string) string {
+	if c.Command == SMTP_COMMAND_AUTH && len(c.Args) > 1 {
+		return SMTP_COMMAND_AUTH + " " + c.Args[0] + " " + LOG_REDACTED
+	}
+
+	return strings.TrimSpace(line)
+}
+
+// CommandHandler handles a command of a client.
+type CommandHandler func(c *Conn, command Command)
+
 func (c *Command) Parse(line string) {
 	parts := strings.Fields(line)
 
@@ -24,135 +46,462 @@ func (c *Command) Parse(line string) {
 	c.Command = strings.ToUpper(parts[0])
 
 	c.Args = parts[1:]
+
+	c.RawArgs = strings.TrimSpace(strings.TrimSpace(line)[len(parts[0]):])
 }
 
-func handleHelo(writer *bufio.Writer, s *Server) {
+func handleHelo(c *Conn, command Command) {
+	s := c.server
+	writer := c.writer
+
+	if len(command.Args) == 0 {
+		reply(writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_ARGUMENTS, "HELO requires a domain")
+
+		return
+	}
+
+	// HELO in the middle of a transaction works like RSET
+	c.reset()
+	c.state = stateGreeted
+
 	if s.auth {
 		replyMultiLine(writer, SMTP_STATUS_OK, []string{
 			fmt.Sprintf("%s at your service, [127.0.0.1]", s.address),
-			"AUTH PLAIN",
+			"AUTH " + strings.Join(c.mechanisms(), " "),
 		})
 	} else {
-		reply(writer, SMTP_STATUS_OK, "HELO from server")
+		reply(writer, SMTP_STATUS_OK, "", "HELO from server")
 	}
 }
 
-func handleEhlo(writer *bufio.Writer, s *Server) {
-	if s.auth {
-		replyMultiLine(writer, SMTP_STATUS_OK, []string{
-			fmt.Sprintf("%s at your service, [127.0.0.1]", s.address),
-			"AUTH PLAIN",
-		})
+func handleEhlo(c *Conn, command Command) {
+	s := c.server
+
+	if len(command.Args) == 0 {
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_ARGUMENTS, "EHLO requires a domain")
+
+		return
+	}
+
+	// EHLO in the middle of a transaction works like RSET
+	c.reset()
+	c.state = stateGreeted
+
+	extensions := []string{
+		fmt.Sprintf("%s at your service, [127.0.0.1]", s.address),
+	}
+
+	// SIZE without a value means there is no fixed limit, RFC 1870
+	if s.MaxMessageBytes > 0 {
+		extensions = append(extensions, fmt.Sprintf("SIZE %d", s.MaxMessageBytes))
 	} else {
-		reply(writer, SMTP_STATUS_OK, "EHLO from server")
+		extensions = append(extensions, "SIZE")
 	}
+
+	extensions = append(extensions, "PIPELINING", "ENHANCEDSTATUSCODES", "DSN", "8BITMIME", "SMTPUTF8", "CHUNKING", "BINARYMIME")
+
+	if s.TLSConfig != nil && !c.isTLS() {
+		extensions = append(extensions, SMTP_COMMAND_STARTTLS)
+	}
+
+	// don't advertise AUTH when it would be refused
+	if s.auth && (!s.RequireTLSForAuth || c.isTLS()) {
+		extensions = append(extensions, "AUTH "+strings.Join(c.mechanisms(), " "))
+	}
+
+	replyMultiLine(c.writer, SMTP_STATUS_OK, extensions)
 }
 
-func handleAuth(writer *bufio.Writer, s *Server, command Command) {
+func handleAuth(c *Conn, command Command) {
+	s := c.server
+	writer := c.writer
+
 	if !s.auth {
-		reply(writer, SMTP_STATUS_ERROR_SYNTAX, "Authentication not enabled")
+		reply(writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_COMMAND, "Authentication not enabled")
 
 		return
 	}
 
 	if len(command.Args) == 0 {
-		reply(writer, SMTP_STATUS_ERROR_SYNTAX, "AUTH command requires an argument")
+		reply(writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_ARGUMENTS, "AUTH command requires an argument")
 
 		return
 	}
 
-	fmt.Println("Command Args:", command.Args)
+	if c.state == stateInit {
+		reply(writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "Send EHLO first")
+
+		return
+	}
 
-	// check if auth is not plain
-	if strings.ToUpper(command.Args[0]) != "PLAIN" {
-		reply(writer, SMTP_STATUS_ERROR_SYNTAX, "Only PLAIN authentication is supported")
+	if c.authUser != "" {
+		reply(writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "Already authenticated")
 
 		return
 	}
 
-	// decode base64
-	decoded, err := base64.StdEncoding.DecodeString(command.Args[1])
-	if err != nil {
-		reply(writer, SMTP_STATUS_ERROR_SYNTAX, "Invalid base64 encoding")
+	if c.state != stateGreeted {
+		reply(writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "AUTH not permitted during a mail transaction")
+
+		return
+	}
+
+	if s.RequireTLSForAuth && !c.isTLS() {
+		reply(writer, SMTP_STATUS_ERROR_ENCRYPTION_REQUIRED, SMTP_ENHANCED_ENCRYPTION_REQUIRED, "Encryption required for requested authentication mechanism")
+
+		return
 	}
 
-	// split username and password
-	if valid := s.ValidateAuth(strings.Split(string(decoded), "\x00")[1], strings.Split(string(decoded), "\x00")[2]); !valid {
-		reply(writer, SMTP_STATUS_ERROR_SYNTAX, "Invalid username or password")
+	exchange, err := sasl.NewServer(command.Args[0], s.Credentials, c.saslOptions())
+	if err != nil {
+		reply(writer, SMTP_STATUS_ERROR_PARAMETER_NOT_IMPLEMENTED, SMTP_ENHANCED_INVALID_ARGUMENTS, "Unrecognized authentication type")
 
 		return
 	}
 
-	reply(writer, SMTP_STATUS_AUTH_SUCCESS, "Authentication successful")
+	// the initial response is optional, "=" is an empty one (RFC 4954)
+	var response []byte
+	if len(command.Args) > 1 {
+		response = []byte{}
+
+		if command.Args[1] != "=" {
+			decoded, err := base64.StdEncoding.DecodeString(command.Args[1])
+			if err != nil {
+				reply(writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_SYNTAX_ERROR, "Invalid base64 encoding")
+
+				return
+			}
+
+			response = decoded
+		}
+	}
+
+	for {
+		challenge, done, err := exchange.Next(response)
+		if err != nil {
+			replySASLError(c, err)
+
+			return
+		}
+
+		// additional data with the success is sent as a challenge, answered
+		// with an empty response
+		if done && len(challenge) == 0 {
+			break
+		}
+
+		replyAuth(writer, challenge)
+
+		response, err = readAuthResponse(c)
+		if err != nil {
+			replySASLError(c, err)
+
+			return
+		}
+
+		if done {
+			if len(response) != 0 {
+				replySASLError(c, sasl.ErrUnexpectedResponse)
+
+				return
+			}
+
+			break
+		}
+	}
+
+	c.authUser = exchange.Username()
+
+	reply(writer, SMTP_STATUS_AUTH_SUCCESS, SMTP_ENHANCED_AUTH_SUCCESS, "Authentication successful")
+}
+
+var errAuthCancelled = errors.New("authentication cancelled")
+
+// read the response to a challenge, "*" cancels the exchange
+func readAuthResponse(c *Conn) ([]byte, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.Close()
+
+		return nil, err
+	}
+
+	line = strings.TrimSpace(line)
+
+	if line == "*" {
+		fmt.Println("Client:", line)
+
+		return nil, errAuthCancelled
+	}
+
+	fmt.Println("Client:", LOG_REDACTED)
+
+	return base64.StdEncoding.DecodeString(line)
 }
 
-func handleMail(writer *bufio.Writer, mail *Mail, command Command) {
+func replySASLError(c *Conn, err error) {
+	// the authenticated user is only kept after a successful exchange
+	c.authUser = ""
+
+	switch {
+	case c.closed:
+		slog.Error("Error reading from connection", "ERROR", err.Error())
+	case errors.Is(err, errAuthCancelled):
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_SYNTAX_ERROR, "Authentication cancelled")
+	case errors.Is(err, sasl.ErrInvalidCredentials):
+		reply(c.writer, SMTP_STATUS_ERROR_AUTH_INVALID, SMTP_ENHANCED_INVALID_CREDENTIALS, "Authentication credentials invalid")
+	case errors.Is(err, sasl.ErrTemporaryFailure):
+		slog.Error("Error checking credentials", "ERROR", err.Error())
+		reply(c.writer, SMTP_STATUS_ERROR_AUTH_TEMPORARY, SMTP_ENHANCED_TEMPORARY_AUTH_FAILURE, "Temporary authentication failure")
+	default:
+		var smtpErr *SMTPError
+		if errors.As(err, &smtpErr) {
+			replyError(c.writer, smtpErr)
+
+			return
+		}
+
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_SYNTAX_ERROR, "Invalid authentication response")
+	}
+}
+
+func handleMail(c *Conn, command Command) {
+	switch {
+	case c.state == stateInit:
+		reply(c.writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "Send HELO or EHLO first")
+
+		return
+	case c.state != stateGreeted:
+		reply(c.writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "Nested MAIL command")
+
+		return
+	case c.server.RequireAuth && c.authUser == "":
+		reply(c.writer, SMTP_STATUS_ERROR_AUTH_REQUIRED, SMTP_ENHANCED_SECURITY, "Authentication required")
+
+		return
+	}
+
 	if len(command.Args) == 0 {
-		reply(writer, SMTP_STATUS_ERROR_SYNTAX, "MAIL command requires an argument")
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_ARGUMENTS, "MAIL command requires an argument")
 
 		return
 	}
 
-	s := strings.Split(command.Args[0], ":")
-	r := strings.NewReplacer("<", "", ">", "")
+	from, params, err := parseCommandPath(command.RawArgs, "FROM:")
+	if err != nil {
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_BAD_SENDER_SYNTAX, "Syntax error in MAIL command, "+err.Error())
+
+		return
+	}
+
+	opts, err := parseMailOptions(params)
+	if errors.Is(err, errUnknownParameter) {
+		reply(c.writer, SMTP_STATUS_ERROR_PARAMETERS_NOT_RECOGNIZED, SMTP_ENHANCED_INVALID_ARGUMENTS, "MAIL FROM parameters not recognized or not implemented")
+
+		return
+	}
+
+	if err != nil {
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_ARGUMENTS, "Syntax error in MAIL parameters, "+err.Error())
+
+		return
+	}
+
+	// addresses with UTF-8 need SMTPUTF8, RFC 6531 section 3.5
+	if !opts.UTF8 && !isASCII(command.RawArgs) {
+		reply(c.writer, SMTP_STATUS_ERROR_MAILBOX_NAME_NOT_ALLOWED, SMTP_ENHANCED_UTF8_REQUIRED, "Non-ASCII address requires SMTPUTF8")
+
+		return
+	}
+
+	if max := c.server.MaxMessageBytes; max > 0 && opts.Size > max {
+		reply(c.writer, SMTP_STATUS_ERROR_EXCEEDED_STORAGE, SMTP_ENHANCED_MESSAGE_TOO_BIG, "Message size exceeds fixed maximum message size")
+
+		return
+	}
+
+	if err := c.session.Mail(from, opts); err != nil {
+		replyError(c.writer, err)
+
+		return
+	}
 
-	mail.SetFrom(r.Replace(s[1]))
+	c.mail.SetFrom(from)
+	c.mail.BodyType = opts.Body
+	c.mail.UTF8 = opts.UTF8
+	c.mail.Return = opts.Return
+	c.mail.EnvelopeID = opts.EnvelopeID
+	c.mailOptions = opts
+	c.state = stateMail
 
-	reply(writer, SMTP_STATUS_OK, "MAIL command accepted")
+	reply(c.writer, SMTP_STATUS_OK, SMTP_ENHANCED_SENDER_OK, "MAIL command accepted")
 }
 
-func handleRcpt(writer *bufio.Writer, mail *Mail, command Command) {
+func handleRcpt(c *Conn, command Command) {
+	if c.state == stateChunking {
+		reply(c.writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "BDAT transaction in progress")
+
+		return
+	}
+
+	if c.state != stateMail && c.state != stateRcpt {
+		reply(c.writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "Need MAIL command first")
+
+		return
+	}
+
 	if len(command.Args) == 0 {
-		reply(writer, SMTP_STATUS_ERROR_SYNTAX, "RCPT command requires an argument")
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_ARGUMENTS, "RCPT command requires an argument")
+
+		return
+	}
+
+	to, params, err := parseCommandPath(command.RawArgs, "TO:")
+	if err == nil && to == "" {
+		err = errors.New("recipient can't be empty")
+	}
+
+	if err != nil {
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_BAD_DESTINATION_SYNTAX, "Syntax error in RCPT command, "+err.Error())
+
+		return
+	}
+
+	opts, err := parseRcptOptions(params)
+	if errors.Is(err, errUnknownParameter) {
+		reply(c.writer, SMTP_STATUS_ERROR_PARAMETERS_NOT_RECOGNIZED, SMTP_ENHANCED_INVALID_ARGUMENTS, "RCPT TO parameters not recognized or not implemented")
+
+		return
+	}
+
+	if err != nil {
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_ARGUMENTS, "Syntax error in RCPT parameters, "+err.Error())
 
 		return
 	}
 
-	s := strings.Split(command.Args[0], ":")
-	r := strings.NewReplacer("<", "", ">", "")
+	if !c.mailOptions.UTF8 && !isASCII(command.RawArgs) {
+		reply(c.writer, SMTP_STATUS_ERROR_MAILBOX_NAME_NOT_ALLOWED, SMTP_ENHANCED_UTF8_REQUIRED, "Non-ASCII address requires SMTPUTF8")
 
-	mail.AddTo(r.Replace(s[1]))
+		return
+	}
+
+	if err := c.session.Rcpt(to, opts); err != nil {
+		replyError(c.writer, err)
+
+		return
+	}
+
+	c.mail.AddTo(to)
+	c.mail.Recipients[to] = opts
+	c.state = stateRcpt
 
-	reply(writer, SMTP_STATUS_OK, "RCPT command accepted")
+	reply(c.writer, SMTP_STATUS_OK, SMTP_ENHANCED_DESTINATION_OK, "RCPT command accepted")
 }
 
-func handleData(writer *bufio.Writer, reader *bufio.Reader, mail *Mail) {
-	reply(writer, SMTP_STATUS_SEND_DATA, "End data with <CR><LF>.<CR><LF>")
+func handleData(c *Conn, command Command) {
+	if c.state == stateChunking {
+		reply(c.writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "BDAT transaction in progress")
 
-	data := ""
+		return
+	}
 
-	for {
-		line, err := reader.ReadString('\n')
+	if c.state != stateRcpt {
+		reply(c.writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "Need RCPT command first")
 
-		fmt.Println("Client:", strings.TrimSpace(line))
+		return
+	}
 
-		if err != nil {
-			slog.Error("Error reading from connection", "ERROR", err.Error())
-			return
-		}
+	if c.mailOptions != nil && c.mailOptions.Body == "BINARYMIME" {
+		reply(c.writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "BODY=BINARYMIME requires BDAT")
 
-		if strings.TrimSpace(line) == "." {
-			break
-		}
+		return
+	}
+
+	reply(c.writer, SMTP_STATUS_SEND_DATA, "", "End data with <CR><LF>.<CR><LF>")
+	c.writer.Flush()
+
+	// the transaction is finished whatever the session returns
+	defer c.reset()
+
+	r := newDataReader(c.reader, c.server.MaxMessageBytes)
+	err := c.session.Data(r)
+
+	// the session may not read the whole message
+	if drainErr := r.drain(); drainErr != nil {
+		slog.Error("Error reading from connection", "ERROR", drainErr.Error())
+		c.Close()
+
+		return
+	}
+
+	if r.tooLarge {
+		replyError(c.writer, errMessageTooLarge)
 
-		data += line
+		return
 	}
 
-	mail.Parse(data)
+	if err != nil {
+		replyError(c.writer, err)
+
+		return
+	}
 
-	reply(writer, SMTP_STATUS_OK, "Mail accepted")
+	reply(c.writer, SMTP_STATUS_OK, SMTP_ENHANCED_MESSAGE_OK, "Mail accepted")
 }
 
-func handleRset(writer *bufio.Writer) {
-	reply(writer, SMTP_STATUS_OK, "Resetting")
+// upgrade the connection to TLS, the connection is closed when the
+// handshake fails
+func handleStartTLS(c *Conn, command Command) {
+	if c.server.TLSConfig == nil {
+		reply(c.writer, SMTP_STATUS_ERROR_NOT_IMPLEMENTED, SMTP_ENHANCED_INVALID_COMMAND, "TLS not available")
+
+		return
+	}
+
+	if c.isTLS() {
+		reply(c.writer, SMTP_STATUS_ERROR_BAD_SEQUENCE, SMTP_ENHANCED_INVALID_COMMAND, "Already running in TLS")
+
+		return
+	}
+
+	if len(command.Args) != 0 {
+		reply(c.writer, SMTP_STATUS_ERROR_SYNTAX, SMTP_ENHANCED_INVALID_ARGUMENTS, "STARTTLS takes no arguments")
+
+		return
+	}
+
+	reply(c.writer, SMTP_STATUS_READY, SMTP_ENHANCED_OK, "Ready to start TLS")
+	c.writer.Flush()
+
+	tlsConn := tls.Server(c.conn, c.server.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		slog.Error("Error during TLS handshake", "ERROR", err.Error())
+		c.Close()
+
+		return
+	}
+
+	// anything the client sent before the handshake is discarded with the old
+	// reader, the session starts over as if the client just connected
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	c.writer = bufio.NewWriter(tlsConn)
+	c.reset()
+	c.state = stateInit
+	c.authUser = ""
 }
 
-func handleNoop(writer *bufio.Writer) {
-	reply(writer, SMTP_STATUS_OK, "I'm with you <3")
+func handleRset(c *Conn, command Command) {
+	reply(c.writer, SMTP_STATUS_OK, SMTP_ENHANCED_OK, "Resetting")
+	c.reset()
 }
 
-func handleQuit(writer *bufio.Writer, mail *Mail) {
-	fmt.Println(mail)
+func handleNoop(c *Conn, command Command) {
+	reply(c.writer, SMTP_STATUS_OK, SMTP_ENHANCED_OK, "I'm with you <3")
+}
 
-	reply(writer, SMTP_STATUS_BYE, "Dadah!")
+func handleQuit(c *Conn, command Command) {
+	reply(c.writer, SMTP_STATUS_BYE, SMTP_ENHANCED_OK, "Dadah!")
+	c.Close()
 }
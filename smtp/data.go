@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var errMessageTooLarge = NewSMTPError(SMTP_STATUS_ERROR_EXCEEDED_STORAGE, SMTP_ENHANCED_MESSAGE_TOO_BIG, "Message size exceeds fixed maximum message size")
+
+// dataReader reads the message after DATA. Leading dots are removed (RFC 5321
+// section 4.5.2) and io.EOF is returned at the terminating <CRLF>.<CRLF>.
+type dataReader struct {
+	r *bufio.Reader
+	// maximum size of the message, 0 means no limit
+	max  int64
+	size int64
+
+	buf       []byte
+	lineStart bool
+	done      bool
+	tooLarge  bool
+	err       error
+}
+
+func newDataReader(r *bufio.Reader, max int64) *dataReader {
+	return &dataReader{
+		r:         r,
+		max:       max,
+		lineStart: true,
+	}
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.tooLarge {
+			return 0, errMessageTooLarge
+		}
+
+		if d.err != nil {
+			return 0, d.err
+		}
+
+		if d.done {
+			return 0, io.EOF
+		}
+
+		d.fill()
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+
+	return n, nil
+}
+
+// read the next line, or a part of it when the line is longer than the buffer
+func (d *dataReader) fill() {
+	line, err := d.r.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		d.err = err
+
+		return
+	}
+
+	complete := err == nil
+
+	if d.lineStart && complete {
+		fmt.Println("Client:", strings.TrimSpace(string(line)))
+
+		if string(line) == ".\r\n" || string(line) == ".\n" {
+			d.done = true
+
+			return
+		}
+	}
+
+	if d.lineStart && len(line) > 0 && line[0] == '.' {
+		line = line[1:]
+	}
+
+	d.lineStart = complete
+
+	d.size += int64(len(line))
+	if d.max > 0 && d.size > d.max {
+		d.tooLarge = true
+
+		return
+	}
+
+	d.buf = line
+}
+
+// read the rest of the message, so the next command can be read
+func (d *dataReader) drain() error {
+	d.buf = nil
+
+	for !d.done && d.err == nil {
+		d.fill()
+		d.buf = nil
+	}
+
+	return d.err
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDataReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		max   int64
+		want  string
+		err   error
+	}{
+		{"empty", ".\r\n", 0, "", nil},
+		{"simple", "Subject: hi\r\n\r\nbody\r\n.\r\n", 0, "Subject: hi\r\n\r\nbody\r\n", nil},
+		{"dot-stuffed line", "..\r\n..leading\r\n.\r\n", 0, ".\r\n.leading\r\n", nil},
+		{"dot in the middle", "a.b\r\n.\r\n", 0, "a.b\r\n", nil},
+		{"single dot is kept", ".x\r\n.\r\n", 0, "x\r\n", nil},
+		{"bare lf", "line\n.\n", 0, "line\n", nil},
+		{"dot after bare cr", "a\r.\r\n.\r\n", 0, "a\r.\r\n", nil},
+		{"long line", strings.Repeat("x", 10000) + "\r\n.\r\n", 0, strings.Repeat("x", 10000) + "\r\n", nil},
+		{"dot after long line", strings.Repeat("x", 5000) + ".\r\n.\r\n", 0, strings.Repeat("x", 5000) + ".\r\n", nil},
+		{"within limit", "12345678\r\n.\r\n", 10, "12345678\r\n", nil},
+		{"too large", "123456789\r\n.\r\n", 10, "", errMessageTooLarge},
+		{"unexpected eof", "body\r\n", 0, "", io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a small buffer to split long lines
+			r := newDataReader(bufio.NewReaderSize(strings.NewReader(tt.input+"QUIT\r\n"), 4096), tt.max)
+
+			got, err := io.ReadAll(r)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ReadAll() error = %v, want %v", err, tt.err)
+			}
+
+			if tt.err == nil && string(got) != tt.want {
+				t.Errorf("ReadAll() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// the rest of the message is skipped so the next command can be read
+func TestDataReaderDrain(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		max   int64
+	}{
+		{"unread message", "a\r\n..b\r\nc\r\n.\r\n", 0},
+		{"too large", "0123456789\r\n0123456789\r\n.\r\n", 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tt.input + "QUIT\r\n"))
+			r := newDataReader(br, tt.max)
+
+			// the session reads one byte only
+			r.Read(make([]byte, 1))
+
+			if err := r.drain(); err != nil {
+				t.Fatal(err)
+			}
+
+			line, _ := br.ReadString('\n')
+			if line != "QUIT\r\n" {
+				t.Errorf("next line = %q, want %q", line, "QUIT\r\n")
+			}
+		})
+	}
+}
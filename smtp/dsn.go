@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// actions of a recipient in a DSN, RFC 3464 section 2.3.3
+const (
+	DSN_ACTION_FAILED  = "failed"
+	DSN_ACTION_RELAYED = "relayed"
+)
+
+// RecipientStatus is the delivery status of a recipient reported in a DSN.
+type RecipientStatus struct {
+	Recipient string
+	// DSN_ACTION_FAILED or DSN_ACTION_RELAYED
+	Action string
+	Status EnhancedCode
+	// the reason, an *SMTPError is reported as the reply of the remote server
+	Err error
+}
+
+// NewDSN creates the delivery status notification (RFC 3464) of mail, sent
+// back to its sender. reportingMTA is the host name of this server.
+// Recipients are left out when they didn't ask for the notification with
+// NOTIFY, ok is false when no recipient is left or the mail has the null
+// reverse-path.
+func NewDSN(mail Mail, reportingMTA string, statuses []RecipientStatus) (dsn Mail, ok bool) {
+	// never bounce a bounce
+	if mail.From == "" {
+		return Mail{}, false
+	}
+
+	var reported []RecipientStatus
+	for _, status := range statuses {
+		if shouldNotify(mail.Recipients[status.Recipient], status.Action) {
+			reported = append(reported, status)
+		}
+	}
+
+	if len(reported) == 0 {
+		return Mail{}, false
+	}
+
+	boundary := newBoundary()
+	now := time.Now().Format(time.RFC1123Z)
+
+	dsn = NewMail()
+	dsn.SetFrom("")
+	dsn.AddTo(mail.From)
+	dsn.BodyType = mail.BodyType
+	dsn.UTF8 = mail.UTF8
+
+	failed := false
+	for _, status := range reported {
+		failed = failed || status.Action == DSN_ACTION_FAILED
+	}
+
+	subject := "Undelivered Mail Returned to Sender"
+	if !failed {
+		subject = "Successful Mail Delivery Report"
+	}
+
+	var b strings.Builder
+
+	b.WriteString("This is a MIME-encapsulated message.\r\n\r\n")
+
+	// human readable part
+	b.WriteString("--" + boundary + "\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString("This is the mail system at host " + reportingMTA + ".\r\n\r\n")
+
+	if failed {
+		b.WriteString("Your message could not be delivered to one or more recipients.\r\n\r\n")
+	} else {
+		b.WriteString("Your message was relayed to a server that does not send delivery\r\n")
+		b.WriteString("notifications, no further notification will be sent.\r\n\r\n")
+	}
+
+	for _, status := range reported {
+		fmt.Fprintf(&b, "<%s>: %s\r\n", status.Recipient, describeStatus(status))
+	}
+
+	b.WriteString("\r\n")
+
+	// machine readable part
+	b.WriteString("--" + boundary + "\r\n")
+	b.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	b.WriteString("Reporting-MTA: dns; " + reportingMTA + "\r\n")
+
+	if mail.EnvelopeID != "" {
+		b.WriteString("Original-Envelope-Id: " + fieldValue(mail.EnvelopeID) + "\r\n")
+	}
+
+	b.WriteString("Arrival-Date: " + now + "\r\n")
+
+	for _, status := range reported {
+		b.WriteString("\r\n")
+
+		if opts := mail.Recipients[status.Recipient]; opts != nil && opts.OriginalRecipient != "" {
+			b.WriteString("Original-Recipient: " + fieldValue(opts.OriginalRecipientType) + "; " + fieldValue(opts.OriginalRecipient) + "\r\n")
+		}
+
+		b.WriteString("Final-Recipient: rfc822; " + status.Recipient + "\r\n")
+		b.WriteString("Action: " + status.Action + "\r\n")
+		b.WriteString("Status: " + string(status.Status) + "\r\n")
+
+		var smtpErr *SMTPError
+		if errors.As(status.Err, &smtpErr) {
+			b.WriteString("Diagnostic-Code: smtp; " + smtpErr.Error() + "\r\n")
+		}
+	}
+
+	b.WriteString("\r\n")
+
+	// the original message, only the headers with RET=HDRS or when no
+	// recipient failed (RFC 3461 section 4.3)
+	b.WriteString("--" + boundary + "\r\n")
+
+	message := mail.message()
+	if mail.Return == "HDRS" || mail.BodyType == "BINARYMIME" || !failed {
+		headers, _, _ := strings.Cut(message, "\r\n\r\n")
+
+		b.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+		b.WriteString(headers + "\r\n\r\n")
+	} else {
+		b.WriteString("Content-Type: message/rfc822\r\n\r\n")
+		b.WriteString(message + "\r\n")
+	}
+
+	b.WriteString("--" + boundary + "--\r\n")
+
+	// the headers are kept in this order
+	headers := []string{
+		"From: Mail Delivery System <MAILER-DAEMON@" + reportingMTA + ">",
+		"To: <" + mail.From + ">",
+		"Date: " + now,
+		"Subject: " + subject,
+		"Auto-Submitted: auto-replied",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/report; report-type=delivery-status; boundary="` + boundary + `"`,
+	}
+
+	dsn.Parse(strings.Join(headers, "\r\n") + "\r\n\r\n" + b.String())
+
+	return dsn, true
+}
+
+// check NOTIFY of a recipient, FAILURE is the default. DELAY is never
+// reported as there is no queue retrying the delivery.
+func shouldNotify(opts *RcptOptions, action string) bool {
+	notify := []string{"FAILURE"}
+	if opts != nil && len(opts.Notify) > 0 {
+		notify = opts.Notify
+	}
+
+	for _, n := range notify {
+		switch {
+		case n == "FAILURE" && action == DSN_ACTION_FAILED:
+			return true
+		case n == "SUCCESS" && action == DSN_ACTION_RELAYED:
+			return true
+		}
+	}
+
+	return false
+}
+
+func describeStatus(status RecipientStatus) string {
+	if status.Err != nil {
+		return status.Err.Error()
+	}
+
+	return "delivery " + status.Action + " with status " + string(status.Status)
+}
+
+func newBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// a value from the envelope in a header field, it is xtext encoded when it
+// has control characters so it can't add fields to the DSN
+func fieldValue(s string) string {
+	for i := 0; i < len(s); i++ {
+		if isControl(s[i]) {
+			return encodeXtext(s)
+		}
+	}
+
+	return s
+}
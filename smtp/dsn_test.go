@@ -0,0 +1,183 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNewDSN(t *testing.T) {
+	mail := NewMail()
+	mail.SetFrom("alice@example.org")
+	mail.AddTo("bob@example.org")
+	mail.AddTo("carol@example.org")
+	mail.AddTo("dave@example.org")
+	mail.EnvelopeID = "QQ314159"
+	mail.Recipients["carol@example.org"] = &RcptOptions{Notify: []string{"NEVER"}}
+	mail.Recipients["dave@example.org"] = &RcptOptions{Notify: []string{"SUCCESS"}, OriginalRecipientType: "rfc822", OriginalRecipient: "Dave@example.org"}
+	mail.Parse("Subject: hello\r\n\r\nsecret body\r\n")
+
+	refused := NewSMTPError(550, "5.1.1", "No such user")
+
+	// values set by the API can't add fields either
+	injected := NewMail()
+	injected.SetFrom("alice@example.org")
+	injected.AddTo("bob@example.org")
+	injected.EnvelopeID = "id\r\nX-Injected: 1"
+	injected.Recipients["bob@example.org"] = &RcptOptions{OriginalRecipientType: "rfc822", OriginalRecipient: "bob@example.org\r\nAction: delivered"}
+	injected.Parse("Subject: hello\r\n\r\nbody\r\n")
+
+	tests := []struct {
+		name     string
+		mail     Mail
+		statuses []RecipientStatus
+		ok       bool
+		// parts of the DSN, and parts it must not contain
+		contains []string
+		excludes []string
+	}{
+		{
+			name: "failed",
+			mail: mail,
+			statuses: []RecipientStatus{
+				{Recipient: "bob@example.org", Action: DSN_ACTION_FAILED, Status: "5.1.1", Err: refused},
+			},
+			ok: true,
+			contains: []string{
+				"Subject: Undelivered Mail Returned to Sender",
+				"Original-Envelope-Id: QQ314159",
+				"Final-Recipient: rfc822; bob@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 No such user",
+				"Content-Type: message/rfc822",
+				"secret body",
+			},
+		},
+		{
+			name: "relayed",
+			mail: mail,
+			statuses: []RecipientStatus{
+				{Recipient: "bob@example.org", Action: DSN_ACTION_RELAYED, Status: SMTP_ENHANCED_OK},
+				{Recipient: "dave@example.org", Action: DSN_ACTION_RELAYED, Status: SMTP_ENHANCED_OK},
+			},
+			ok: true,
+			contains: []string{
+				"Subject: Successful Mail Delivery Report",
+				"Original-Recipient: rfc822; Dave@example.org\r\nFinal-Recipient: rfc822; dave@example.org\r\nAction: relayed\r\nStatus: 2.0.0",
+				"Content-Type: text/rfc822-headers",
+			},
+			// bob didn't ask for it, only the headers are returned
+			excludes: []string{"bob@example.org", "secret body"},
+		},
+		{
+			name: "control characters",
+			mail: injected,
+			statuses: []RecipientStatus{
+				{Recipient: "bob@example.org", Action: DSN_ACTION_FAILED, Status: "5.1.1", Err: refused},
+			},
+			ok: true,
+			contains: []string{
+				"Original-Envelope-Id: id+0D+0AX-Injected:+201\r\n",
+				"Original-Recipient: rfc822; bob@example.org+0D+0AAction:+20delivered\r\n",
+			},
+			excludes: []string{"\r\nX-Injected", "\r\nAction: delivered"},
+		},
+		{
+			name: "notify never",
+			mail: mail,
+			statuses: []RecipientStatus{
+				{Recipient: "carol@example.org", Action: DSN_ACTION_FAILED, Status: "5.1.1", Err: refused},
+			},
+		},
+		{
+			name: "null reverse-path",
+			mail: Mail{To: []string{"bob@example.org"}},
+			statuses: []RecipientStatus{
+				{Recipient: "bob@example.org", Action: DSN_ACTION_FAILED, Status: "5.1.1", Err: refused},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn, ok := NewDSN(tt.mail, "mx.example.org", tt.statuses)
+			if ok != tt.ok {
+				t.Fatalf("NewDSN() ok = %v, want %v", ok, tt.ok)
+			}
+
+			if !ok {
+				return
+			}
+
+			if dsn.From != "" || len(dsn.To) != 1 || dsn.To[0] != "alice@example.org" {
+				t.Errorf("envelope = %q -> %q", dsn.From, dsn.To)
+			}
+
+			message := dsn.message()
+			for _, s := range tt.contains {
+				if !strings.Contains(message, s) {
+					t.Errorf("DSN does not contain %q:\n%s", s, message)
+				}
+			}
+
+			for _, s := range tt.excludes {
+				if strings.Contains(message, s) {
+					t.Errorf("DSN contains %q:\n%s", s, message)
+				}
+			}
+		})
+	}
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want EnhancedCode
+	}{
+		{"smtp error", NewSMTPError(550, "5.7.1", "Relaying denied"), "5.7.1"},
+		{"smtp error without enhanced code", NewSMTPError(554, "", "Transaction failed"), "5.0.0"},
+		// transient failures aren't retried, the failure is permanent
+		{"greylisted", NewSMTPError(451, "4.7.1", "Greylisted, try again later"), "5.7.1"},
+		{"transient without enhanced code", NewSMTPError(452, "", "Too many recipients"), "5.0.0"},
+		{"smtputf8", ErrSMTPUTF8NotSupported, SMTP_ENHANCED_UTF8_REQUIRED},
+		{"8bitmime", Err8BitMIMENotSupported, SMTP_ENHANCED_CONVERSION_REQUIRED},
+		{"domain not found", &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, SMTP_ENHANCED_BAD_DESTINATION_SYSTEM},
+		{"null mx", ErrNullMX, SMTP_ENHANCED_NULL_MX},
+		{"connection", errors.New("connection refused"), "5.4.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deliveryStatus(tt.err); got != tt.want {
+				t.Errorf("deliveryStatus() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// a transient reply of the next hop fails with a permanent status, the reply
+// is kept in the Diagnostic-Code
+func TestNewDSNTransientFailure(t *testing.T) {
+	mail := NewMail()
+	mail.SetFrom("alice@example.org")
+	mail.AddTo("bob@example.org")
+	mail.Parse("Subject: hello\r\n\r\nbody\r\n")
+
+	status := failedStatus("bob@example.org", NewSMTPError(451, "4.7.1", "Greylisted, try again later"))
+
+	dsn, ok := NewDSN(mail, "mx.example.org", []RecipientStatus{status})
+	if !ok {
+		t.Fatal("NewDSN() ok = false")
+	}
+
+	message := dsn.message()
+
+	want := "Action: failed\r\nStatus: 5.7.1\r\nDiagnostic-Code: smtp; 451 4.7.1 Greylisted, try again later\r\n"
+	if !strings.Contains(message, want) {
+		t.Errorf("DSN does not contain %q:\n%s", want, message)
+	}
+
+	if strings.Contains(message, "Status: 4.") {
+		t.Errorf("DSN has a transient status:\n%s", message)
+	}
+}
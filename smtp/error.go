@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// EnhancedCode is an enhanced status code, class.subject.detail (RFC 3463).
+type EnhancedCode string
+
+const (
+	SMTP_ENHANCED_OK             EnhancedCode = "2.0.0"
+	SMTP_ENHANCED_SENDER_OK      EnhancedCode = "2.1.0"
+	SMTP_ENHANCED_DESTINATION_OK EnhancedCode = "2.1.5"
+	SMTP_ENHANCED_MESSAGE_OK     EnhancedCode = "2.6.0"
+	SMTP_ENHANCED_AUTH_SUCCESS   EnhancedCode = "2.7.0"
+
+	SMTP_ENHANCED_MAILBOX_BUSY           EnhancedCode = "4.2.0"
+	SMTP_ENHANCED_LOCAL_ERROR            EnhancedCode = "4.3.0"
+	SMTP_ENHANCED_SYSTEM_UNAVAILABLE     EnhancedCode = "4.3.2"
+	SMTP_ENHANCED_NO_ANSWER              EnhancedCode = "4.4.1"
+	SMTP_ENHANCED_TEMPORARY_AUTH_FAILURE EnhancedCode = "4.7.0"
+
+	SMTP_ENHANCED_BAD_MAILBOX            EnhancedCode = "5.1.1"
+	SMTP_ENHANCED_BAD_DESTINATION_SYSTEM EnhancedCode = "5.1.2"
+	SMTP_ENHANCED_BAD_DESTINATION_SYNTAX EnhancedCode = "5.1.3"
+	SMTP_ENHANCED_BAD_SENDER_SYNTAX      EnhancedCode = "5.1.7"
+	SMTP_ENHANCED_NULL_MX                EnhancedCode = "5.1.10"
+	SMTP_ENHANCED_MESSAGE_TOO_BIG        EnhancedCode = "5.3.4"
+	SMTP_ENHANCED_INVALID_COMMAND        EnhancedCode = "5.5.1"
+	SMTP_ENHANCED_SYNTAX_ERROR           EnhancedCode = "5.5.2"
+	SMTP_ENHANCED_INVALID_ARGUMENTS      EnhancedCode = "5.5.4"
+	SMTP_ENHANCED_CONVERSION_REQUIRED    EnhancedCode = "5.6.3"
+	SMTP_ENHANCED_UTF8_REQUIRED          EnhancedCode = "5.6.7"
+	SMTP_ENHANCED_SECURITY               EnhancedCode = "5.7.0"
+	SMTP_ENHANCED_INVALID_CREDENTIALS    EnhancedCode = "5.7.8"
+	SMTP_ENHANCED_ENCRYPTION_REQUIRED    EnhancedCode = "5.7.11"
+)
+
+// SMTPError can be returned by a Session to reply with a specific code and
+// message. A missing EnhancedCode is replaced by class.0.0 of the code.
+type SMTPError struct {
+	Code         int
+	EnhancedCode EnhancedCode
+	Message      string
+}
+
+func NewSMTPError(code int, enhancedCode EnhancedCode, message string) *SMTPError {
+	return &SMTPError{
+		Code:         code,
+		EnhancedCode: enhancedCode,
+		Message:      message,
+	}
+}
+
+func (e *SMTPError) Error() string {
+	enhanced := enhancedCode(e.Code, e.EnhancedCode)
+	if enhanced == "" {
+		return fmt.Sprintf("%d %s", e.Code, e.Message)
+	}
+
+	return fmt.Sprintf("%d %s %s", e.Code, enhanced, e.Message)
+}
+
+func toSMTPError(err error) *SMTPError {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+
+	return NewSMTPError(SMTP_STATUS_ERROR_LOCAL, SMTP_ENHANCED_LOCAL_ERROR, "Requested action aborted: local error in processing")
+}
+
+// the enhanced code of a reply, class.0.0 when none is given. Only 2xx, 4xx
+// and 5xx replies have an enhanced code.
+func enhancedCode(code int, enhanced EnhancedCode) EnhancedCode {
+	if enhanced != "" {
+		return enhanced
+	}
+
+	if class := code / 100; class != 2 && class != 4 && class != 5 {
+		return ""
+	}
+
+	return EnhancedCode(fmt.Sprintf("%d.0.0", code/100))
+}
@@ -2,9 +2,236 @@ package server
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"sort"
+	"strings"
 )
 
+// ErrNullMX fails the recipients of a domain that publishes a null MX, it
+// doesn't accept any mail (RFC 7505)
+var ErrNullMX = NewSMTPError(SMTP_STATUS_ERROR_DOMAIN_NO_MAIL, SMTP_ENHANCED_NULL_MX, "Recipient address has null MX")
+
+// Forwarder relays mail to the MX hosts of the recipient domains. The sender
+// gets a delivery status notification (RFC 3461) for the recipients that
+// failed, and with NOTIFY=SUCCESS for the recipients relayed to a server
+// without DSN support, as far as they asked for it with NOTIFY.
+type Forwarder struct {
+	// host name of this server, reported in the DSN
+	Hostname string
+}
+
+func NewForwarder(hostname string) *Forwarder {
+	return &Forwarder{
+		Hostname: hostname,
+	}
+}
+
+// DeliveryError is returned by Forward when the mail was not delivered to
+// every recipient. The forwarder has no queue, temporary failures are not
+// retried and fail like permanent ones, see deliveryStatus.
+type DeliveryError struct {
+	Statuses []RecipientStatus
+}
+
+func (e *DeliveryError) Error() string {
+	recipients := make([]string, len(e.Statuses))
+	for i, status := range e.Statuses {
+		recipients[i] = status.Recipient + " (" + status.Action + ")"
+	}
+
+	return "delivery failed for " + strings.Join(recipients, ", ")
+}
+
+// Forward sends the mail to every recipient, the DSN is sent before Forward
+// returns a *DeliveryError.
+func (f *Forwarder) Forward(mail Mail) error {
+	domains := make(map[string][]string)
+	for _, to := range mail.To {
+		domain := to[strings.LastIndex(to, "@")+1:]
+		domains[domain] = append(domains[domain], to)
+	}
+
+	names := make([]string, 0, len(domains))
+	for domain := range domains {
+		names = append(names, domain)
+	}
+
+	sort.Strings(names)
+
+	var statuses []RecipientStatus
+	for _, domain := range names {
+		m := mail
+		m.To = domains[domain]
+
+		dsn, err := f.send(domain, m)
+
+		// with a RcptError only the refused recipients failed, the others
+		// got the mail
+		refused := make(map[string]error)
+
+		var rcptErr *RcptError
+		switch {
+		case errors.As(err, &rcptErr):
+			refused = rcptErr.Errors
+		case err != nil:
+			for _, to := range m.To {
+				refused[to] = err
+			}
+		}
+
+		for _, to := range m.To {
+			if err, ok := refused[to]; ok {
+				statuses = append(statuses, failedStatus(to, err))
+
+				continue
+			}
+
+			// the next hop won't notify the sender of the delivery, RFC 3461
+			// section 5.2.2
+			if !dsn {
+				statuses = append(statuses, RecipientStatus{
+					Recipient: to,
+					Action:    DSN_ACTION_RELAYED,
+					Status:    SMTP_ENHANCED_OK,
+				})
+			}
+		}
+	}
+
+	if dsn, ok := NewDSN(mail, f.Hostname, statuses); ok {
+		if err := f.Forward(dsn); err != nil {
+			slog.Error("Error sending delivery status notification", "ERROR", err.Error())
+		}
+	}
+
+	var failed []RecipientStatus
+	for _, status := range statuses {
+		if status.Action == DSN_ACTION_FAILED {
+			failed = append(failed, status)
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return &DeliveryError{Statuses: failed}
+}
+
+// NewForwardSession returns a Session relaying the mail received on c with
+// the forwarder. The DSN parameters of the transaction are passed on to the
+// next hop, the failed recipients are reported to the sender with a DSN.
+// The mail is relayed before DATA is answered, the timeouts of the Dialer
+// limit how long a next hop that stops answering keeps the client waiting.
+func NewForwardSession(c *Conn, f *Forwarder) Session {
+	return &forwardSession{conn: c, forwarder: f}
+}
+
+type forwardSession struct {
+	conn      *Conn
+	forwarder *Forwarder
+}
+
+func (s *forwardSession) Mail(from string, opts *MailOptions) error {
+	return nil
+}
+
+func (s *forwardSession) Rcpt(to string, opts *RcptOptions) error {
+	return nil
+}
+
+func (s *forwardSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	mail := s.conn.Mail()
+	mail.Header = make(map[string]string)
+	mail.Parse(string(data))
+
+	// the mail is accepted, the sender already got the DSN
+	if err := s.forwarder.Forward(mail); err != nil {
+		slog.Error("Error forwarding mail", "ERROR", err.Error())
+	}
+
+	return nil
+}
+
+func (s *forwardSession) Reset() {}
+
+func (s *forwardSession) Logout() error {
+	return nil
+}
+
+// send the mail to the MX of domain, dsn reports whether the server that
+// accepted it supports DSN
+func (f *Forwarder) send(domain string, mail Mail) (dsn bool, err error) {
+	records, err := lookupMx(domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return false, err
+		}
+
+		// without MX record the domain itself is the mail server, RFC 5321
+		// section 5.1
+		records = []*net.MX{{Host: domain}}
+	}
+
+	return sendMailToMx(records, mail)
+}
+
+// the status of a recipient the mail could not be delivered to
+func failedStatus(recipient string, err error) RecipientStatus {
+	return RecipientStatus{
+		Recipient: recipient,
+		Action:    DSN_ACTION_FAILED,
+		Status:    deliveryStatus(err),
+		Err:       err,
+	}
+}
+
+// the enhanced status code of a failed delivery. The failure is final as
+// nothing retries the delivery, a transient code (4.X.X) is reported as the
+// permanent code with the same subject and detail, a failed action can't
+// have a transient status (RFC 3464 section 2.3.4). The reply of the remote
+// server is still reported as it was in the Diagnostic-Code.
+func deliveryStatus(err error) EnhancedCode {
+	code := errorStatus(err)
+	if strings.HasPrefix(string(code), "4.") {
+		return "5." + code[2:]
+	}
+
+	return code
+}
+
+// the enhanced status code of a delivery error
+func errorStatus(err error) EnhancedCode {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		return enhancedCode(smtpErr.Code, smtpErr.EnhancedCode)
+	}
+
+	if errors.Is(err, ErrSMTPUTF8NotSupported) {
+		return SMTP_ENHANCED_UTF8_REQUIRED
+	}
+
+	if errors.Is(err, Err8BitMIMENotSupported) {
+		return SMTP_ENHANCED_CONVERSION_REQUIRED
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return SMTP_ENHANCED_BAD_DESTINATION_SYSTEM
+	}
+
+	return SMTP_ENHANCED_NO_ANSWER
+}
+
 func lookupMx(domain string) ([]*net.MX, error) {
 	record, err := net.LookupMX(domain)
 	if err != nil {
@@ -14,20 +241,44 @@ func lookupMx(domain string) ([]*net.MX, error) {
 	return record, nil
 }
 
-func sendMailToMx(records []*net.MX, mail Mail) error {
+// send the mail to the first MX accepting it, the mail is not downgraded
+// when a server lacks SMTPUTF8 or 8BITMIME. dsn reports whether that server
+// supports DSN.
+func sendMailToMx(records []*net.MX, mail Mail) (dsn bool, err error) {
+	// a single record with the host "." is a null MX, RFC 7505 section 3
+	if len(records) == 1 && strings.TrimSuffix(records[0].Host, ".") == "" {
+		return false, ErrNullMX
+	}
+
+	var lastErr error
 	for _, record := range records {
-		addr := record.Host + ":25"
-		conn, err := net.Dial("tcp", addr)
-		if err != nil {
+		// an empty host would dial this machine
+		host := strings.TrimSuffix(record.Host, ".")
+		if host == "" {
 			continue
 		}
 
-		defer conn.Close()
+		dialer := NewDialer(host, "25")
 
-		// TODO: sending mail here
+		err := dialer.SendMail(mail, nil)
+		_, dsn := dialer.extensions["DSN"]
 
-		return nil
+		if err == nil {
+			return dsn, nil
+		}
+
+		// the other recipients may already have the mail
+		var rcptErr *RcptError
+		if errors.As(err, &rcptErr) {
+			return dsn, err
+		}
+
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return false, errors.New("could not send mail to any mx")
 	}
 
-	return errors.New("could not send mail to any mx")
+	return false, fmt.Errorf("could not send mail to any mx: %w", lastErr)
 }
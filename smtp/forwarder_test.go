@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSendMailToMxNullMX(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []*net.MX
+		nullMX  bool
+	}{
+		{"null mx", []*net.MX{{Host: ".", Pref: 0}}, true},
+		{"empty host", []*net.MX{{Host: ""}}, true},
+		// not a valid null MX, but "." is never dialed
+		{"null mx with others", []*net.MX{{Host: ".", Pref: 0}, {Host: ".", Pref: 10}}, false},
+	}
+
+	mail := NewMail()
+	mail.SetFrom("alice@example.org")
+	mail.AddTo("bob@example.org")
+	mail.Parse("Subject: hello\r\n\r\nbody\r\n")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := sendMailToMx(tt.records, mail)
+			if err == nil {
+				t.Fatal("sendMailToMx() succeeded")
+			}
+
+			if errors.Is(err, ErrNullMX) != tt.nullMX {
+				t.Errorf("sendMailToMx() error = %v, null MX %v", err, tt.nullMX)
+			}
+		})
+	}
+}
@@ -1,3 +1,12 @@
 module github.com/radenrishwan/smtp
 
 go 1.22.4
+
+require (
+	github.com/radenrishwan/sasl v0.0.0-00010101000000-000000000000
+	golang.org/x/net v0.35.0
+)
+
+require golang.org/x/text v0.22.0 // indirect
+
+replace github.com/radenrishwan/sasl => ../sasl
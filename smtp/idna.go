@@ -0,0 +1,40 @@
+package server
+
+import (
+	"errors"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+var errInvalidDomain = errors.New("invalid domain")
+
+// convert a domain to its ASCII form. Non-ASCII domains are mapped with the
+// UTS #46 lookup profile (case folding, NFC, width mapping) and encoded as
+// xn-- labels (RFC 5890, RFC 5891)
+func domainToASCII(domain string) (string, error) {
+	if isASCII(domain) {
+		return domain, nil
+	}
+
+	if !utf8.ValidString(domain) {
+		return "", errInvalidDomain
+	}
+
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", errInvalidDomain
+	}
+
+	return ascii, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,48 @@
+package server
+
+import "testing"
+
+func TestDomainToASCII(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+		want   string
+		err    bool
+	}{
+		{"ascii", "example.com", "example.com", false},
+		{"ascii upper case is kept", "Example.COM", "Example.COM", false},
+		{"latin", "bücher.example", "xn--bcher-kva.example", false},
+		{"upper case is folded", "BÜCHER.example", "xn--bcher-kva.example", false},
+		{"nfc", "münchen.de", "xn--mnchen-3ya.de", false},
+		{"nfd is composed", "mu\u0308nchen.de", "xn--mnchen-3ya.de", false},
+		{"japanese", "例え.テスト", "xn--r8jz45g.xn--zckzah", false},
+		{"ideographic full stop", "例え。テスト", "xn--r8jz45g.xn--zckzah", false},
+		{"full width", "ｅｘａｍｐｌｅ.ｃｏｍ", "example.com", false},
+		{"sharp s", "faß.de", "xn--fa-hia.de", false},
+		{"greek final sigma", "βόλος.com", "xn--nxasmm1c.com", false},
+		{"invalid utf-8", "b\xfccher.example", "", true},
+		{"disallowed code point", "exa\u2028mple.com", "", true},
+		{"leading hyphen", "-bücher.example", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := domainToASCII(tt.domain)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("domainToASCII(%q) = %q, want error", tt.domain, got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("domainToASCII(%q) error: %v", tt.domain, err)
+			}
+
+			if got != tt.want {
+				t.Errorf("domainToASCII(%q) = %q, want %q", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
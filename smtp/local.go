@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	// returned by a LocalStore when a user has no mailbox
+	ErrNoSuchUser = errors.New("no such user")
+	// returned by a LocalStore when a mailbox can't be locked in time
+	ErrMailboxBusy = errors.New("mailbox is busy")
+)
+
+// LocalStore keeps the mailboxes of local users, e.g. maildir or mbox.
+type LocalStore interface {
+	// Exists reports whether the user has a mailbox.
+	Exists(username string) bool
+	// Deliver stores the message for every user, from is the envelope
+	// sender.
+	Deliver(usernames []string, from string, r io.Reader) error
+}
+
+// NewLocalSession returns a Session delivering mail to the mailbox of the
+// local part of every recipient. A Return-Path header with the envelope
+// sender is added to the message.
+func NewLocalSession(store LocalStore) Session {
+	return &localSession{store: store}
+}
+
+type localSession struct {
+	store     LocalStore
+	from      string
+	usernames []string
+}
+
+func (s *localSession) Mail(from string, opts *MailOptions) error {
+	s.from = from
+
+	return nil
+}
+
+func (s *localSession) Rcpt(to string, opts *RcptOptions) error {
+	username := LocalUsername(to)
+	if !s.store.Exists(username) {
+		return NewSMTPError(SMTP_STATUS_ERROR_MAILBOX_UNAVAILABLE, SMTP_ENHANCED_BAD_MAILBOX, "No such user here")
+	}
+
+	// several addresses of the same user get one copy
+	for _, u := range s.usernames {
+		if u == username {
+			return nil
+		}
+	}
+
+	s.usernames = append(s.usernames, username)
+
+	return nil
+}
+
+func (s *localSession) Data(r io.Reader) error {
+	returnPath := strings.NewReader("Return-Path: <" + s.from + ">\r\n")
+
+	err := s.store.Deliver(s.usernames, s.from, io.MultiReader(returnPath, r))
+	if errors.Is(err, ErrNoSuchUser) {
+		return NewSMTPError(SMTP_STATUS_ERROR_MAILBOX_UNAVAILABLE, SMTP_ENHANCED_BAD_MAILBOX, "No such user here")
+	}
+
+	if errors.Is(err, ErrMailboxBusy) {
+		return NewSMTPError(SMTP_STATUS_ERROR_LOCAL, SMTP_ENHANCED_MAILBOX_BUSY, "Mailbox is busy, try again later")
+	}
+
+	return err
+}
+
+func (s *localSession) Reset() {
+	s.from = ""
+	s.usernames = nil
+}
+
+func (s *localSession) Logout() error {
+	return nil
+}
+
+// LocalUsername returns the user of an address, the lowercase local part.
+func LocalUsername(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		address = address[:i]
+	}
+
+	return strings.ToLower(address)
+}
@@ -1,31 +1,107 @@
 package server
 
-import "strings"
+import (
+	"sort"
+	"strings"
+)
 
 type Mail struct {
 	From   string
 	To     []string
 	Header map[string]string
 	Body   string
+	// the message as received, it is sent unchanged by the Dialer. Header
+	// and Body are only used to build the message when Raw is empty
+	Raw string
+
+	// BODY= of MAIL FROM, 7BIT, 8BITMIME or BINARYMIME
+	BodyType string
+	// the addresses or headers contain UTF-8, the next hop has to support
+	// SMTPUTF8
+	UTF8 bool
+
+	// RET= and ENVID= of MAIL FROM, RFC 3461
+	Return     string
+	EnvelopeID string
+	// NOTIFY= and ORCPT= of every recipient in To
+	Recipients map[string]*RcptOptions
 }
 
 func NewMail() Mail {
 	return Mail{
-		Header: make(map[string]string),
+		Header:     make(map[string]string),
+		Recipients: make(map[string]*RcptOptions),
 	}
 }
 
+// Parse keeps the message in Raw and fills Header and Body, folded header
+// lines are unfolded. Only the last of repeated headers is kept in Header.
 func (m *Mail) Parse(data string) {
+	m.Raw = data
+
 	lines := strings.Split(data, "\r\n")
 
+	key := ""
 	for i, line := range lines {
 		if line == "" {
 			m.Body = strings.Join(lines[i+1:], "\r\n")
 			break
 		}
 
+		// continuation of a folded header, RFC 5322 section 2.2.3
+		if line[0] == ' ' || line[0] == '\t' {
+			if key != "" {
+				m.Header[key] += " " + strings.TrimSpace(line)
+			}
+
+			continue
+		}
+
 		parts := strings.SplitN(line, ":", 2)
-		m.Header[parts[0]] = strings.TrimSpace(parts[1])
+		if len(parts) != 2 {
+			key = ""
+
+			continue
+		}
+
+		key = parts[0]
+		m.Header[key] = strings.TrimSpace(parts[1])
+	}
+}
+
+// the message with CRLF line endings, Raw or else the headers and body of
+// the mail
+func (m *Mail) message() string {
+	var b strings.Builder
+
+	if m.Raw != "" {
+		writeLines(&b, m.Raw)
+
+		return b.String()
+	}
+
+	keys := make([]string, 0, len(m.Header))
+	for key := range m.Header {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		b.WriteString(key + ": " + m.Header[key] + "\r\n")
+	}
+
+	b.WriteString("\r\n")
+	writeLines(&b, m.Body)
+
+	return b.String()
+}
+
+// write the lines of s, each ending with CRLF
+func writeLines(b *strings.Builder, s string) {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		b.WriteString(line + "\r\n")
 	}
 }
 
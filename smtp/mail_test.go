@@ -0,0 +1,69 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMailParse(t *testing.T) {
+	data := "Received: from a by b\r\n" +
+		"Received: from c\r\n" +
+		"\tby d\r\n" +
+		"Subject: a long\r\n" +
+		"  subject\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	m := NewMail()
+	m.Parse(data)
+
+	want := map[string]string{
+		"Received": "from c by d",
+		"Subject":  "a long subject",
+	}
+
+	if !reflect.DeepEqual(m.Header, want) {
+		t.Errorf("Header = %q, want %q", m.Header, want)
+	}
+
+	if m.Body != "body\r\n" {
+		t.Errorf("Body = %q", m.Body)
+	}
+
+	// the message is sent as received
+	if got := m.message(); got != data {
+		t.Errorf("message() = %q, want %q", got, data)
+	}
+}
+
+func TestMailMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		mail Mail
+		want string
+	}{
+		{
+			name: "raw with bare lf",
+			mail: Mail{Raw: "Subject: hi\n\nbody\n"},
+			want: "Subject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name: "raw without final line break",
+			mail: Mail{Raw: "Subject: hi\r\n\r\nbody"},
+			want: "Subject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name: "header and body",
+			mail: Mail{Header: map[string]string{"To": "b@example.org", "From": "a@example.org"}, Body: "line 1\nline 2"},
+			want: "From: a@example.org\r\nTo: b@example.org\r\n\r\nline 1\r\nline 2\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.mail.message(); got != tt.want {
+				t.Errorf("message() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MailOptions are the ESMTP parameters of MAIL FROM.
+type MailOptions struct {
+	// SIZE=, the declared size of the message, 0 if not given
+	Size int64
+	// BODY=, 7BIT, 8BITMIME or BINARYMIME
+	Body string
+	// SMTPUTF8
+	UTF8 bool
+	// RET=, FULL or HDRS
+	Return string
+	// ENVID=, decoded from xtext
+	EnvelopeID string
+	// AUTH=, decoded from xtext
+	Auth string
+}
+
+// RcptOptions are the ESMTP parameters of RCPT TO.
+type RcptOptions struct {
+	// NOTIFY=, NEVER or any of SUCCESS, FAILURE and DELAY
+	Notify []string
+	// ORCPT=, the address type (e.g. rfc822) and the decoded original address
+	OriginalRecipientType string
+	OriginalRecipient     string
+}
+
+var errUnknownParameter = errors.New("parameter not recognized")
+
+type parameter struct {
+	key   string
+	value string
+}
+
+// parse the argument of MAIL or RCPT, e.g. "FROM:<a@b> SIZE=100" with prefix
+// "FROM:". The path is returned without angle brackets and source route, the
+// null path <> is returned as an empty string.
+func parseCommandPath(arg string, prefix string) (string, []parameter, error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, errors.New("expected " + prefix + "<address>")
+	}
+
+	// a space after the colon is not allowed, but sent by many clients
+	rest := strings.TrimLeft(arg[len(prefix):], " ")
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, errors.New("address must be enclosed in <>")
+	}
+
+	end := closingBracket(rest)
+	if end < 0 {
+		return "", nil, errors.New("missing closing >")
+	}
+
+	path := rest[1:end]
+	rest = rest[end+1:]
+
+	if rest != "" && rest[0] != ' ' {
+		return "", nil, errors.New("parameters must be separated by a space")
+	}
+
+	if path == "" {
+		params, err := parseParameters(rest)
+
+		return "", params, err
+	}
+
+	// the source route is ignored, RFC 5321 section 4.1.1.3
+	if strings.HasPrefix(path, "@") {
+		i := strings.Index(path, ":")
+		if i < 0 {
+			return "", nil, errors.New("invalid source route")
+		}
+
+		for _, hop := range strings.Split(path[:i], ",") {
+			if !strings.HasPrefix(hop, "@") || !isDomain(hop[1:]) {
+				return "", nil, errors.New("invalid source route")
+			}
+		}
+
+		path = path[i+1:]
+	}
+
+	// RCPT TO:<Postmaster> doesn't need a domain
+	if prefix != "TO:" || !strings.EqualFold(path, "postmaster") {
+		mailbox, err := validateMailbox(path)
+		if err != nil {
+			return "", nil, err
+		}
+
+		path = mailbox
+	}
+
+	params, err := parseParameters(rest)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return path, params, nil
+}
+
+// index of the > closing the path, > in a quoted local part is skipped
+func closingBracket(s string) int {
+	quoted := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == '>':
+			return i
+		}
+	}
+
+	return -1
+}
+
+// check a mailbox, local-part "@" domain. The mailbox is returned with the
+// domain in its ASCII form, the local part may contain UTF-8 (RFC 6531).
+func validateMailbox(mailbox string) (string, error) {
+	if !utf8.ValidString(mailbox) {
+		return "", errors.New("address is not valid UTF-8")
+	}
+
+	at := strings.LastIndex(mailbox, "@")
+	if at < 0 {
+		return "", errors.New("address must contain a domain")
+	}
+
+	local, domain := mailbox[:at], mailbox[at+1:]
+
+	if !isLocalPart(local) {
+		return "", errors.New("invalid local part")
+	}
+
+	if isAddressLiteral(domain) {
+		return mailbox, nil
+	}
+
+	domain, err := domainToASCII(domain)
+	if err != nil || !isDomain(domain) {
+		return "", errors.New("invalid domain")
+	}
+
+	return local + "@" + domain, nil
+}
+
+func isLocalPart(local string) bool {
+	if strings.HasPrefix(local, "\"") {
+		return isQuotedString(local)
+	}
+
+	if local == "" {
+		return false
+	}
+
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return false
+		}
+
+		for _, c := range atom {
+			if !isAtext(c) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// atext, including the non-ASCII characters allowed by RFC 6531
+func isAtext(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", c) || c >= utf8.RuneSelf
+}
+
+func isQuotedString(s string) bool {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return false
+	}
+
+	for i := 1; i < len(s)-1; i++ {
+		c := s[i]
+
+		switch {
+		case c == '\\':
+			// quoted-pair, any printable character or space
+			i++
+			if i >= len(s)-1 || s[i] < 32 || s[i] == 127 {
+				return false
+			}
+		case c == '"':
+			return false
+		case c < 32 || c == 127:
+			return false
+		}
+	}
+
+	return true
+}
+
+func isDomain(domain string) bool {
+	if domain == "" || len(domain) > 255 {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// e.g. [127.0.0.1] or [IPv6:::1]
+func isAddressLiteral(domain string) bool {
+	if len(domain) < 3 || domain[0] != '[' || domain[len(domain)-1] != ']' {
+		return false
+	}
+
+	for _, c := range domain[1 : len(domain)-1] {
+		if c < 33 || c > 126 || c == '[' || c == ']' || c == '\\' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parse the esmtp-params after the path, keywords are upper cased
+func parseParameters(s string) ([]parameter, error) {
+	var params []parameter
+	for _, field := range strings.Fields(s) {
+		key, value, hasValue := strings.Cut(field, "=")
+
+		if key == "" || key[0] == '-' {
+			return nil, errors.New("invalid parameter " + field)
+		}
+
+		for _, c := range key {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return nil, errors.New("invalid parameter " + field)
+			}
+		}
+
+		if hasValue && value == "" {
+			return nil, errors.New("missing value of parameter " + key)
+		}
+
+		for _, c := range value {
+			if c < 33 || c > 126 || c == '=' {
+				return nil, errors.New("invalid value of parameter " + key)
+			}
+		}
+
+		params = append(params, parameter{key: strings.ToUpper(key), value: value})
+	}
+
+	return params, nil
+}
+
+func parseMailOptions(params []parameter) (*MailOptions, error) {
+	opts := &MailOptions{}
+
+	for _, param := range params {
+		switch param.key {
+		case "SIZE":
+			size, err := strconv.ParseInt(param.value, 10, 64)
+			if err != nil || size < 0 {
+				return nil, errors.New("invalid SIZE")
+			}
+
+			opts.Size = size
+		case "BODY":
+			body := strings.ToUpper(param.value)
+			if body != "7BIT" && body != "8BITMIME" && body != "BINARYMIME" {
+				return nil, errors.New("invalid BODY")
+			}
+
+			opts.Body = body
+		case "SMTPUTF8":
+			if param.value != "" {
+				return nil, errors.New("SMTPUTF8 takes no value")
+			}
+
+			opts.UTF8 = true
+		case "RET":
+			ret := strings.ToUpper(param.value)
+			if ret != "FULL" && ret != "HDRS" {
+				return nil, errors.New("invalid RET")
+			}
+
+			opts.Return = ret
+		case "ENVID":
+			envid, err := decodeXtext(param.value)
+			if err != nil || envid == "" {
+				return nil, errors.New("invalid ENVID")
+			}
+
+			opts.EnvelopeID = envid
+		case "AUTH":
+			auth, err := decodeXtext(param.value)
+			if err != nil || auth == "" {
+				return nil, errors.New("invalid AUTH")
+			}
+
+			opts.Auth = auth
+		default:
+			return nil, errUnknownParameter
+		}
+	}
+
+	return opts, nil
+}
+
+func parseRcptOptions(params []parameter) (*RcptOptions, error) {
+	opts := &RcptOptions{}
+
+	for _, param := range params {
+		switch param.key {
+		case "NOTIFY":
+			notify := strings.Split(strings.ToUpper(param.value), ",")
+			for _, n := range notify {
+				if n != "SUCCESS" && n != "FAILURE" && n != "DELAY" && n != "NEVER" {
+					return nil, errors.New("invalid NOTIFY")
+				}
+
+				if n == "NEVER" && len(notify) > 1 {
+					return nil, errors.New("NOTIFY=NEVER can't be combined")
+				}
+			}
+
+			opts.Notify = notify
+		case "ORCPT":
+			addrType, addr, ok := strings.Cut(param.value, ";")
+			if !ok || addrType == "" {
+				return nil, errors.New("invalid ORCPT")
+			}
+
+			decoded, err := decodeXtext(addr)
+			if err != nil || decoded == "" {
+				return nil, errors.New("invalid ORCPT")
+			}
+
+			opts.OriginalRecipientType = strings.ToLower(addrType)
+			opts.OriginalRecipient = decoded
+		default:
+			return nil, errUnknownParameter
+		}
+	}
+
+	return opts, nil
+}
+
+// decode xtext, RFC 3461 section 4, "+XX" is the hex encoded character.
+// Control characters are refused, the values end up in the header fields of
+// a DSN.
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if isControl(s[i]) {
+			return "", errors.New("invalid xtext")
+		}
+
+		if s[i] != '+' {
+			b.WriteByte(s[i])
+
+			continue
+		}
+
+		if i+2 >= len(s) {
+			return "", errors.New("invalid xtext")
+		}
+
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil || s[i+1] >= 'a' || s[i+2] >= 'a' || isControl(byte(c)) {
+			return "", errors.New("invalid xtext")
+		}
+
+		b.WriteByte(byte(c))
+		i += 2
+	}
+
+	return b.String(), nil
+}
+
+// encode xtext, characters outside of "!" to "~" and "+" and "=" are hex
+// encoded
+func encodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c > 126 || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+
+			continue
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// CTL of RFC 5234, the characters below space and DEL
+func isControl(c byte) bool {
+	return c < 32 || c == 127
+}
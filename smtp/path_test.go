@@ -0,0 +1,182 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseCommandPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		arg    string
+		prefix string
+		path   string
+		params []parameter
+		err    bool
+	}{
+		{"simple", "FROM:<alice@example.org>", "FROM:", "alice@example.org", nil, false},
+		{"lower case prefix", "from:<alice@example.org>", "FROM:", "alice@example.org", nil, false},
+		{"space after colon", "FROM: <alice@example.org>", "FROM:", "alice@example.org", nil, false},
+		{"null path", "FROM:<>", "FROM:", "", nil, false},
+		{"null path with parameters", "FROM:<> BODY=8BITMIME", "FROM:", "", []parameter{{"BODY", "8BITMIME"}}, false},
+		{"parameters", "FROM:<alice@example.org> size=100 SMTPUTF8", "FROM:", "alice@example.org", []parameter{{"SIZE", "100"}, {"SMTPUTF8", ""}}, false},
+		{"source route", "TO:<@relay.example,@hop.example:bob@example.org>", "TO:", "bob@example.org", nil, false},
+		{"postmaster", "TO:<Postmaster>", "TO:", "Postmaster", nil, false},
+		{"quoted local part", `TO:<"bob smith"@example.org>`, "TO:", `"bob smith"@example.org`, nil, false},
+		{"quoted >", `TO:<"a>b"@example.org>`, "TO:", `"a>b"@example.org`, nil, false},
+		{"quoted pair", `TO:<"a\"b"@example.org>`, "TO:", `"a\"b"@example.org`, nil, false},
+		{"address literal", "TO:<bob@[192.0.2.1]>", "TO:", "bob@[192.0.2.1]", nil, false},
+		{"ipv6 literal", "TO:<bob@[IPv6:2001:db8::1]>", "TO:", "bob@[IPv6:2001:db8::1]", nil, false},
+		{"utf-8 local part", "TO:<用户@example.org>", "TO:", "用户@example.org", nil, false},
+		{"idn domain", "TO:<bob@bücher.example>", "TO:", "bob@xn--bcher-kva.example", nil, false},
+		{"wrong prefix", "TO:<bob@example.org>", "FROM:", "", nil, true},
+		{"missing brackets", "FROM:alice@example.org", "FROM:", "", nil, true},
+		{"missing closing bracket", "FROM:<alice@example.org", "FROM:", "", nil, true},
+		{"parameter not separated", "FROM:<alice@example.org>SIZE=1", "FROM:", "", nil, true},
+		{"missing domain", "FROM:<alice>", "FROM:", "", nil, true},
+		{"postmaster in MAIL", "FROM:<postmaster>", "FROM:", "", nil, true},
+		{"empty atom", "FROM:<alice..smith@example.org>", "FROM:", "", nil, true},
+		{"invalid domain", "FROM:<alice@-example.org>", "FROM:", "", nil, true},
+		{"invalid source route", "TO:<@relay.example bob@example.org>", "TO:", "", nil, true},
+		{"invalid utf-8", "FROM:<\xffalice@example.org>", "FROM:", "", nil, true},
+		{"parameter without value", "FROM:<alice@example.org> SIZE=", "FROM:", "", nil, true},
+		{"invalid parameter", "FROM:<alice@example.org> -SIZE=1", "FROM:", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, params, err := parseCommandPath(tt.arg, tt.prefix)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parseCommandPath(%q) = %q, want error", tt.arg, path)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseCommandPath(%q) error: %v", tt.arg, err)
+			}
+
+			if path != tt.path || !reflect.DeepEqual(params, tt.params) {
+				t.Errorf("parseCommandPath(%q) = %q, %v, want %q, %v", tt.arg, path, params, tt.path, tt.params)
+			}
+		})
+	}
+}
+
+func TestParseMailOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []parameter
+		want   *MailOptions
+		err    error
+	}{
+		{"none", nil, &MailOptions{}, nil},
+		{"size", []parameter{{"SIZE", "1024"}}, &MailOptions{Size: 1024}, nil},
+		{"body", []parameter{{"BODY", "8bitmime"}}, &MailOptions{Body: "8BITMIME"}, nil},
+		{"smtputf8", []parameter{{"SMTPUTF8", ""}}, &MailOptions{UTF8: true}, nil},
+		{"dsn", []parameter{{"RET", "hdrs"}, {"ENVID", "QQ314159+2B+3D"}}, &MailOptions{Return: "HDRS", EnvelopeID: "QQ314159+="}, nil},
+		{"auth", []parameter{{"AUTH", "alice+40example.org"}}, &MailOptions{Auth: "alice@example.org"}, nil},
+		{"negative size", []parameter{{"SIZE", "-1"}}, nil, errors.New("")},
+		{"invalid body", []parameter{{"BODY", "9BIT"}}, nil, errors.New("")},
+		{"smtputf8 with value", []parameter{{"SMTPUTF8", "yes"}}, nil, errors.New("")},
+		{"invalid ret", []parameter{{"RET", "BODY"}}, nil, errors.New("")},
+		{"invalid envid", []parameter{{"ENVID", "a+2"}}, nil, errors.New("")},
+		{"envid with line break", []parameter{{"ENVID", "a+0D+0AX-Injected:+201"}}, nil, errors.New("")},
+		{"unknown", []parameter{{"XFOO", "1"}}, nil, errUnknownParameter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMailOptions(tt.params)
+			checkParseError(t, err, tt.err)
+
+			if tt.err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMailOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRcptOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []parameter
+		want   *RcptOptions
+		err    error
+	}{
+		{"none", nil, &RcptOptions{}, nil},
+		{"notify", []parameter{{"NOTIFY", "success,failure"}}, &RcptOptions{Notify: []string{"SUCCESS", "FAILURE"}}, nil},
+		{"notify never", []parameter{{"NOTIFY", "NEVER"}}, &RcptOptions{Notify: []string{"NEVER"}}, nil},
+		{"orcpt", []parameter{{"ORCPT", "RFC822;bob+2Bsmith@example.org"}}, &RcptOptions{OriginalRecipientType: "rfc822", OriginalRecipient: "bob+smith@example.org"}, nil},
+		{"never combined", []parameter{{"NOTIFY", "NEVER,FAILURE"}}, nil, errors.New("")},
+		{"invalid notify", []parameter{{"NOTIFY", "ALWAYS"}}, nil, errors.New("")},
+		{"orcpt without type", []parameter{{"ORCPT", "bob@example.org"}}, nil, errors.New("")},
+		{"orcpt invalid xtext", []parameter{{"ORCPT", "rfc822;bob+zz"}}, nil, errors.New("")},
+		{"orcpt with line break", []parameter{{"ORCPT", "rfc822;bob@example.org+0D+0AAction:+20delivered"}}, nil, errors.New("")},
+		{"unknown", []parameter{{"SIZE", "1"}}, nil, errUnknownParameter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRcptOptions(tt.params)
+			checkParseError(t, err, tt.err)
+
+			if tt.err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRcptOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// want is nil for no error, errUnknownParameter or any other error
+func checkParseError(t *testing.T, err, want error) {
+	t.Helper()
+
+	switch {
+	case want == nil && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case want == nil:
+	case err == nil:
+		t.Fatal("expected an error")
+	case errors.Is(want, errUnknownParameter) != errors.Is(err, errUnknownParameter):
+		t.Fatalf("error = %v, want %v", err, want)
+	}
+}
+
+func TestXtext(t *testing.T) {
+	tests := []struct {
+		decoded string
+		encoded string
+	}{
+		{"", ""},
+		{"QQ314159", "QQ314159"},
+		{"a+b=c", "a+2Bb+3Dc"},
+		{"with space", "with+20space"},
+		{"ü", "+C3+BC"},
+	}
+
+	for _, tt := range tests {
+		if got := encodeXtext(tt.decoded); got != tt.encoded {
+			t.Errorf("encodeXtext(%q) = %q, want %q", tt.decoded, got, tt.encoded)
+		}
+
+		if got, err := decodeXtext(tt.encoded); err != nil || got != tt.decoded {
+			t.Errorf("decodeXtext(%q) = %q, %v, want %q", tt.encoded, got, err, tt.decoded)
+		}
+	}
+
+	// control characters are encoded, and refused when decoding
+	if got := encodeXtext("tab\there\r\n"); got != "tab+09here+0D+0A" {
+		t.Errorf("encodeXtext() = %q", got)
+	}
+
+	// hexchar is "+" and two upper case hex digits
+	for _, s := range []string{"+", "a+2", "+2b", "+GG", "+-1", "tab+09here", "a+0D+0AX-Injected:+201", "+00", "+7F", "a\rb"} {
+		if got, err := decodeXtext(s); err == nil {
+			t.Errorf("decodeXtext(%q) = %q, want error", s, got)
+		}
+	}
+}
@@ -2,22 +2,42 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"os"
 	"strings"
+
+	"github.com/radenrishwan/sasl"
 )
 
 const (
-	SMTP_STATUS_READY                      = 220
-	SMTP_STATUS_BYE                        = 221
-	SMTP_STATUS_OK                         = 250
-	SMTP_STATUS_SEND_DATA                  = 354
-	SMTP_STATUS_ERROR_COMMAND_UNRECOGNIZED = 500
-	SMTP_STATUS_ERROR_SYNTAX               = 501
-	SMTP_STATUS_ERROR_BAD_SEQUENCE         = 503
-
-	SMTP_STATUS_AUTH_SUCCESS = 235
+	SMTP_STATUS_READY                           = 220
+	SMTP_STATUS_BYE                             = 221
+	SMTP_STATUS_OK                              = 250
+	SMTP_STATUS_SEND_DATA                       = 354
+	SMTP_STATUS_SERVICE_UNAVAILABLE             = 421
+	SMTP_STATUS_ERROR_LOCAL                     = 451
+	SMTP_STATUS_ERROR_AUTH_TEMPORARY            = 454
+	SMTP_STATUS_ERROR_COMMAND_UNRECOGNIZED      = 500
+	SMTP_STATUS_ERROR_SYNTAX                    = 501
+	SMTP_STATUS_ERROR_NOT_IMPLEMENTED           = 502
+	SMTP_STATUS_ERROR_BAD_SEQUENCE              = 503
+	SMTP_STATUS_ERROR_PARAMETER_NOT_IMPLEMENTED = 504
+	SMTP_STATUS_ERROR_AUTH_REQUIRED             = 530
+	SMTP_STATUS_ERROR_AUTH_INVALID              = 535
+	SMTP_STATUS_ERROR_ENCRYPTION_REQUIRED       = 538
+	SMTP_STATUS_ERROR_MAILBOX_UNAVAILABLE       = 550
+	SMTP_STATUS_ERROR_EXCEEDED_STORAGE          = 552
+	SMTP_STATUS_ERROR_MAILBOX_NAME_NOT_ALLOWED  = 553
+	SMTP_STATUS_ERROR_PARAMETERS_NOT_RECOGNIZED = 555
+	SMTP_STATUS_ERROR_DOMAIN_NO_MAIL            = 556
+
+	SMTP_STATUS_AUTH_SUCCESS  = 235
+	SMTP_STATUS_AUTH_CONTINUE = 334
 )
 
 const (
@@ -30,37 +50,94 @@ const (
 	SMTP_COMMAND_RSET = "RSET"
 	SMTP_COMMAND_NOOP = "NOOP"
 	SMTP_COMMAND_QUIT = "QUIT"
+
+	SMTP_COMMAND_STARTTLS = "STARTTLS"
+	SMTP_COMMAND_BDAT     = "BDAT"
 )
 
 type Server struct {
-	address   string
-	auth      bool
-	smtpAuths map[string]SMTPAuth
+	address  string
+	auth     bool
+	backend  Backend
+	commands map[string]CommandHandler
+
+	// users allowed to authenticate, a *sasl.MemoryStore by default
+	Credentials sasl.CredentialStore
+	// host name of the server, used in the CRAM-MD5 challenge
+	Hostname string
+	// enables OAUTHBEARER and XOAUTH2 when set, e.g. a *sasl.JWTVerifier
+	TokenVerifier sasl.TokenVerifier
+
+	// enables STARTTLS when set
+	TLSConfig *tls.Config
+	// refuse AUTH until the connection is encrypted
+	RequireTLSForAuth bool
+	// refuse MAIL until the client is authenticated
+	RequireAuth bool
+	// maximum size of a message in bytes, 0 means no limit
+	MaxMessageBytes int64
 }
 
-func NewServer(address string, auth bool) *Server {
+func NewServer(address string, auth bool, backend Backend) *Server {
 	// add dummy auth
-	smtpAuths := make(map[string]SMTPAuth)
-	smtpAuths["test"] = NewSMTPAuth("test", "test")
-	smtpAuths["test2"] = NewSMTPAuth("test2", "test2")
+	store := sasl.NewMemoryStore()
+	for _, smtpAuth := range []SMTPAuth{NewSMTPAuth("test", "test"), NewSMTPAuth("test2", "test2")} {
+		store.AddPassword(smtpAuth.Username, smtpAuth.Password)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
 
 	return &Server{
-		address:   address,
-		auth:      auth,
-		smtpAuths: smtpAuths,
+		address:     address,
+		auth:        auth,
+		backend:     backend,
+		Credentials: store,
+		Hostname:    hostname,
+		commands: map[string]CommandHandler{
+			SMTP_COMMAND_HELO:     handleHelo,
+			SMTP_COMMAND_EHLO:     handleEhlo,
+			SMTP_COMMAND_AUTH:     handleAuth,
+			SMTP_COMMAND_MAIL:     handleMail,
+			SMTP_COMMAND_RCPT:     handleRcpt,
+			SMTP_COMMAND_DATA:     handleData,
+			SMTP_COMMAND_BDAT:     handleBdat,
+			SMTP_COMMAND_RSET:     handleRset,
+			SMTP_COMMAND_NOOP:     handleNoop,
+			SMTP_COMMAND_STARTTLS: handleStartTLS,
+			SMTP_COMMAND_QUIT:     handleQuit,
+		},
 	}
 }
 
+// HandleCommand registers the handler of a command, replacing the built-in
+// handler if there is one. The handler has to reply to the client.
+func (s *Server) HandleCommand(verb string, handler CommandHandler) {
+	s.commands[strings.ToUpper(verb)] = handler
+}
+
 func (s *Server) ValidateAuth(username, password string) bool {
-	auth, ok := s.smtpAuths[username]
-	if !ok {
-		return false
+	return sasl.CheckPassword(s.Credentials, username, password)
+}
+
+func (s *Server) ListenAndServe() error {
+	if !strings.HasPrefix(s.address, ":") {
+		s.address = ":" + s.address
 	}
 
-	return auth.Password == password
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
 }
 
-func (s *Server) ListenAndServe() error {
+// ListenAndServeTLS listens on the address and serves implicit TLS with
+// TLSConfig, the standard submission port is 465 (RFC 8314).
+func (s *Server) ListenAndServeTLS() error {
 	if !strings.HasPrefix(s.address, ":") {
 		s.address = ":" + s.address
 	}
@@ -70,8 +147,29 @@ func (s *Server) ListenAndServe() error {
 		return err
 	}
 
+	return s.ServeTLS(listener)
+}
+
+// ServeTLS serves implicit TLS with TLSConfig on an existing listener.
+func (s *Server) ServeTLS(listener net.Listener) error {
+	if s.TLSConfig == nil {
+		listener.Close()
+
+		return errors.New("TLSConfig is required")
+	}
+
+	return s.Serve(tls.NewListener(listener, s.TLSConfig))
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+
 		if err != nil {
 			slog.Error("Error accepting connection", "ERROR", err.Error())
 			continue
@@ -82,117 +180,125 @@ func (s *Server) ListenAndServe() error {
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
-
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-
-	reply(writer, SMTP_STATUS_READY, "Service ready")
+	// finish the handshake of implicit TLS, so the session can see the TLS
+	// connection state
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			slog.Error("Error during TLS handshake", "ERROR", err.Error())
+			conn.Close()
 
-	mail := NewMail()
-
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			slog.Error("Error reading from connection", "ERROR", err.Error())
 			return
 		}
+	}
 
-		command := Command{}
-		command.Parse(line)
-
-		fmt.Println("Client:", strings.TrimSpace(line))
-
-		if strings.HasPrefix(strings.ToUpper(command.Command), "*") {
-			handleEhlo(writer, s)
+	c := &Conn{
+		conn:   conn,
+		server: s,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		mail:   NewMail(),
+	}
 
-			continue
-		}
+	// the connection is replaced after STARTTLS
+	defer func() {
+		c.writer.Flush()
+		c.conn.Close()
+	}()
 
-		if strings.HasPrefix(strings.ToUpper(command.Command), SMTP_COMMAND_HELO) {
-			handleHelo(writer, s)
+	session, err := s.backend.NewSession(c)
+	if err != nil {
+		slog.Error("Error creating session", "ERROR", err.Error())
 
-			continue
+		// an SMTPError of the backend is its chosen reply
+		var smtpErr *SMTPError
+		if !errors.As(err, &smtpErr) {
+			smtpErr = NewSMTPError(SMTP_STATUS_SERVICE_UNAVAILABLE, SMTP_ENHANCED_SYSTEM_UNAVAILABLE, "Service not available, closing transmission channel")
 		}
 
-		if strings.HasPrefix(strings.ToUpper(command.Command), SMTP_COMMAND_EHLO) {
-			handleEhlo(writer, s)
+		replyError(c.writer, smtpErr)
 
-			continue
-		}
+		return
+	}
 
-		if strings.HasPrefix(strings.ToUpper(command.Command), SMTP_COMMAND_AUTH) {
-			handleAuth(writer, s, command)
+	c.session = session
 
-			continue
-		}
+	defer func() {
+		c.endChunking(errChunkingAborted)
 
-		if strings.HasPrefix(strings.ToUpper(command.Command), SMTP_COMMAND_MAIL) {
-			handleMail(writer, &mail, command)
-
-			continue
+		if err := session.Logout(); err != nil {
+			slog.Error("Error closing session", "ERROR", err.Error())
 		}
+	}()
 
-		if strings.HasPrefix(strings.ToUpper(command.Command), SMTP_COMMAND_RCPT) {
-			handleRcpt(writer, &mail, command)
+	reply(c.writer, SMTP_STATUS_READY, "", "Service ready")
 
-			continue
+	for {
+		// PIPELINING, RFC 2920: the replies are sent once there are no more
+		// commands waiting to be handled
+		if c.reader.Buffered() == 0 {
+			if err := c.writer.Flush(); err != nil {
+				slog.Error("Error writing to connection", "ERROR", err.Error())
+				return
+			}
 		}
 
-		if strings.HasPrefix(strings.ToUpper(command.Command), SMTP_COMMAND_DATA) {
-			handleData(writer, reader, &mail)
-
-			continue
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			slog.Error("Error reading from connection", "ERROR", err.Error())
+			return
 		}
 
-		if strings.HasPrefix(strings.ToUpper(command.Command), SMTP_COMMAND_RSET) {
-			handleRset(writer)
-			mail = NewMail()
-
-			// clear the reader
-			reader.Reset(conn)
+		command := Command{}
+		command.Parse(line)
 
-			continue
-		}
+		fmt.Println("Client:", command.logLine(line))
 
-		if strings.HasPrefix(strings.ToUpper(command.Command), SMTP_COMMAND_NOOP) {
-			reply(writer, SMTP_STATUS_OK, "Server is here...")
+		handler, ok := s.commands[command.Command]
+		if !ok {
+			reply(c.writer, SMTP_STATUS_ERROR_COMMAND_UNRECOGNIZED, SMTP_ENHANCED_SYNTAX_ERROR, "Syntax error, command unrecognized")
 
 			continue
 		}
 
-		if strings.HasPrefix(strings.ToUpper(command.Command), SMTP_COMMAND_QUIT) {
-			handleQuit(writer, &mail)
+		handler(c, command)
 
+		if c.closed {
 			return
 		}
 	}
 }
 
 func (s *Server) validateAuth(username string, password string) error {
-	if s.auth {
-		for _, auth := range s.smtpAuths {
-			if auth.Username == username && auth.Password == password {
-				return nil
-			}
-		}
-
+	if s.auth && !s.ValidateAuth(username, password) {
+		return sasl.ErrInvalidCredentials
 	}
 
 	return nil
 }
 
-func reply(writer *bufio.Writer, code int, message string) {
+// replies are buffered, they are flushed once all pipelined commands of the
+// client are handled. The enhanced code is left out when empty, which is only
+// done for the greeting and the replies to HELO, EHLO and DATA (RFC 2034).
+func reply(writer *bufio.Writer, code int, enhanced EnhancedCode, message string) {
 	response := fmt.Sprintf("%d %s\r\n", code, message)
+	if enhanced != "" {
+		response = fmt.Sprintf("%d %s %s\r\n", code, enhanced, message)
+	}
 
 	writer.WriteString(response)
-	writer.Flush()
 
 	fmt.Println("Server:", strings.TrimSpace(response))
 }
 
-func replyAuth(writer *bufio.Writer, code int, message string) {
-	response := fmt.Sprintf("%d-%s\r\n", code, message)
+func replyError(writer *bufio.Writer, err error) {
+	smtpErr := toSMTPError(err)
+
+	reply(writer, smtpErr.Code, enhancedCode(smtpErr.Code, smtpErr.EnhancedCode), smtpErr.Message)
+}
+
+// send a SASL challenge, the client has to respond before the next command
+func replyAuth(writer *bufio.Writer, challenge []byte) {
+	response := fmt.Sprintf("%d %s\r\n", SMTP_STATUS_AUTH_CONTINUE, base64.StdEncoding.EncodeToString(challenge))
 
 	writer.WriteString(response)
 	writer.Flush()
@@ -210,5 +316,4 @@ func replyMultiLine(writer *bufio.Writer, code int, messages []string) {
 		}
 		writer.WriteString(response)
 	}
-	writer.Flush()
 }
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testBackend keeps the messages passed to Session.Data
+type testBackend struct {
+	mu       sync.Mutex
+	messages []testMessage
+}
+
+type testMessage struct {
+	mail Mail
+	data string
+}
+
+func (b *testBackend) NewSession(c *Conn) (Session, error) {
+	return &testSession{backend: b, conn: c}, nil
+}
+
+type testSession struct {
+	backend *testBackend
+	conn    *Conn
+}
+
+func (s *testSession) Mail(from string, opts *MailOptions) error {
+	return nil
+}
+
+func (s *testSession) Rcpt(to string, opts *RcptOptions) error {
+	if strings.HasPrefix(to, "unknown@") {
+		return NewSMTPError(SMTP_STATUS_ERROR_MAILBOX_UNAVAILABLE, SMTP_ENHANCED_BAD_MAILBOX, "No such user here")
+	}
+
+	return nil
+}
+
+func (s *testSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+
+	s.backend.messages = append(s.backend.messages, testMessage{mail: s.conn.Mail(), data: string(data)})
+
+	return nil
+}
+
+func (s *testSession) Reset() {}
+
+func (s *testSession) Logout() error {
+	return nil
+}
+
+// send script on a new connection, the codes of the replies are returned
+// without the greeting
+func runScript(t *testing.T, s *Server, script string) []int {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.handleConnection(server)
+		close(done)
+	}()
+
+	// the whole script is sent at once, like a pipelining client
+	go io.WriteString(client, script)
+
+	output, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+
+	var codes []int
+	for _, line := range strings.Split(strings.TrimSuffix(string(output), "\r\n"), "\r\n") {
+		// the last line of a reply
+		if len(line) < 4 || line[3] != ' ' {
+			continue
+		}
+
+		code, err := strconv.Atoi(line[:3])
+		if err != nil {
+			t.Fatalf("invalid reply %q", line)
+		}
+
+		codes = append(codes, code)
+	}
+
+	return codes[1:]
+}
+
+func TestDataTransaction(t *testing.T) {
+	backend := &testBackend{}
+	s := NewServer(":0", false, backend)
+
+	codes := runScript(t, s, "EHLO client.example\r\n"+
+		"MAIL FROM:<alice@example.org> RET=HDRS ENVID=id+2B1 BODY=8BITMIME\r\n"+
+		"RCPT TO:<bob@example.org> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;bob@example.org\r\n"+
+		"RCPT TO:<unknown@example.org>\r\n"+
+		"RCPT TO:<carol@example.org>\r\n"+
+		"DATA\r\n"+
+		"Subject: test\r\n\r\n..hidden dot\r\n.\r\n"+
+		"QUIT\r\n")
+
+	want := []int{250, 250, 250, 550, 250, 354, 250, 221}
+	if !reflect.DeepEqual(codes, want) {
+		t.Fatalf("replies = %v, want %v", codes, want)
+	}
+
+	if len(backend.messages) != 1 {
+		t.Fatalf("%d messages, want 1", len(backend.messages))
+	}
+
+	got := backend.messages[0]
+	if got.data != "Subject: test\r\n\r\n.hidden dot\r\n" {
+		t.Errorf("data = %q", got.data)
+	}
+
+	mail := got.mail
+	if mail.From != "alice@example.org" || !reflect.DeepEqual(mail.To, []string{"bob@example.org", "carol@example.org"}) {
+		t.Errorf("envelope = %q -> %q", mail.From, mail.To)
+	}
+
+	if mail.Return != "HDRS" || mail.EnvelopeID != "id+1" || mail.BodyType != "8BITMIME" {
+		t.Errorf("MAIL parameters = %q, %q, %q", mail.Return, mail.EnvelopeID, mail.BodyType)
+	}
+
+	opts := mail.Recipients["bob@example.org"]
+	if opts == nil || !reflect.DeepEqual(opts.Notify, []string{"SUCCESS", "FAILURE"}) || opts.OriginalRecipient != "bob@example.org" {
+		t.Errorf("RCPT parameters = %+v", opts)
+	}
+}
+
+func TestCommandSequence(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []int
+	}{
+		{"mail before ehlo", "MAIL FROM:<a@example.org>\r\n", []int{503}},
+		{"rcpt before mail", "EHLO x\r\nRCPT TO:<b@example.org>\r\n", []int{250, 503}},
+		{"data before rcpt", "EHLO x\r\nMAIL FROM:<a@example.org>\r\nDATA\r\n", []int{250, 250, 503}},
+		{"nested mail", "EHLO x\r\nMAIL FROM:<a@example.org>\r\nMAIL FROM:<a@example.org>\r\n", []int{250, 250, 503}},
+		{"rset", "EHLO x\r\nMAIL FROM:<a@example.org>\r\nRSET\r\nMAIL FROM:<a@example.org>\r\n", []int{250, 250, 250, 250}},
+		{"unknown command", "EHLO x\r\nFOO\r\n", []int{250, 500}},
+		{"verb prefix", "EHLO x\r\nMAILFROM:<a@example.org>\r\n", []int{250, 500}},
+		{"lower case verb", "ehlo x\r\nnoop\r\n", []int{250, 250}},
+		{"envid with line break", "EHLO x\r\nMAIL FROM:<a@example.org> ENVID=a+0D+0AX:+201\r\n", []int{250, 501}},
+		{"orcpt with line break", "EHLO x\r\nMAIL FROM:<a@example.org>\r\nRCPT TO:<b@example.org> ORCPT=rfc822;b+0A\r\n", []int{250, 250, 501}},
+		{"unknown parameter", "EHLO x\r\nMAIL FROM:<a@example.org> XFOO=1\r\n", []int{250, 555}},
+		{"utf-8 without smtputf8", "EHLO x\r\nMAIL FROM:<ü@example.org>\r\n", []int{250, 553}},
+		{"utf-8 with smtputf8", "EHLO x\r\nMAIL FROM:<ü@bücher.example> SMTPUTF8\r\n", []int{250, 250}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(":0", false, &testBackend{})
+
+			codes := runScript(t, s, tt.script+"QUIT\r\n")
+
+			want := append(tt.want, SMTP_STATUS_BYE)
+			if !reflect.DeepEqual(codes, want) {
+				t.Errorf("replies = %v, want %v", codes, want)
+			}
+		})
+	}
+}